@@ -0,0 +1,218 @@
+package smtpsrv
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	errInvalidLiteral = errors.New("invalid address literal")
+	errPathBrackets   = errors.New("address must be enclosed in angle brackets")
+	errSourceRoute    = errors.New("invalid source route")
+	errNoDomain       = errors.New("address must include a domain")
+	errNoRecipient    = errors.New("recipient address required")
+	errLocalPart      = errors.New("invalid local part")
+	errDomain         = errors.New("invalid domain")
+	errPathLength     = errors.New("address too long")
+)
+
+// parseAddressLiteral parses an address literal as described in RFC 5321
+// section 4.1.3. This is either an IPv4 address or an IPv6 address prefixed
+// with "IPv6:", enclosed in square brackets. Other tags are not supported.
+func parseAddressLiteral(s string) (net.IP, error) {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, errInvalidLiteral
+	}
+	s = s[1 : len(s)-1]
+	if len(s) > 5 && strings.EqualFold(s[:5], "IPv6:") {
+		s = s[5:]
+		if ip := net.ParseIP(s); ip != nil && strings.Contains(s, ":") {
+			return ip, nil
+		}
+		return nil, errInvalidLiteral
+	}
+	if ip := net.ParseIP(s); ip != nil && !strings.Contains(s, ":") {
+		return ip, nil
+	}
+	return nil, errInvalidLiteral
+}
+
+// addressLiteral formats the IP address as an address literal.
+func addressLiteral(ip net.IP) string {
+	if ip.To4() != nil {
+		return "[" + ip.String() + "]"
+	}
+	return "[IPv6:" + ip.String() + "]"
+}
+
+// isAtext determines whether c may appear in an atom (RFC 5322 section
+// 3.2.3). Bytes of UTF-8 sequences are permitted (RFC 6531 section 3.3).
+func isAtext(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+		c >= 0x80 || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) != -1
+}
+
+// validLocalPart determines whether the local part of an address is a
+// Dot-string or Quoted-string (RFC 5321 section 4.1.2). Unless strict is set,
+// Dot-strings may contain leading, trailing, or consecutive dots and any
+// printable character other than those used to delimit the path.
+func validLocalPart(s string, strict bool) bool {
+	if len(s) == 0 {
+		return false
+	}
+	if len(s) > 1 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+		for i := 0; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\':
+				i++
+				if i == len(s) || s[i] < 32 || s[i] > 126 {
+					return false
+				}
+			case c == '"', c < 32, c == 127:
+				return false
+			}
+		}
+		return true
+	}
+	if !strict {
+		return !strings.ContainsAny(s, " \"<>@") && isPrintable(s)
+	}
+	for _, atom := range strings.Split(s, ".") {
+		if len(atom) == 0 {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if !isAtext(atom[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validDomainName determines whether s is a valid domain name, consisting of
+// labels of letters, digits, and hyphens that neither begin nor end with a
+// hyphen. Bytes of UTF-8 sequences are treated as letters. Unless strict is
+// set, underscores are permitted and hyphens may appear anywhere.
+func validDomainName(s string, strict bool) bool {
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if strict && (label[0] == '-' || label[len(label)-1] == '-') {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+				c >= 0x80 || c == '-' || !strict && c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isPrintable determines whether s contains no control characters.
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 32 || s[i] == 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePath parses the Reverse-path or Forward-path supplied with MAIL or
+// RCPT (RFC 5321 section 4.1.2) and returns the mailbox it contains, which is
+// empty for the null path ("<>"). A source route preceding the mailbox is
+// ignored, as required by RFC 5321 appendix C, and "Postmaster" is accepted
+// without a domain. Unless strict is set, paths that are not enclosed in
+// angle brackets and local parts and domains that are malformed in ways
+// commonly seen in practice are accepted, and the limits on length are not
+// enforced.
+func parsePath(s string, strict bool) (string, error) {
+	if len(s) > 1 && s[0] == '<' && s[len(s)-1] == '>' {
+		s = s[1 : len(s)-1]
+	} else if strict {
+		return "", errPathBrackets
+	}
+	if len(s) == 0 {
+		return "", nil
+	}
+	if s[0] == '@' {
+		i := strings.IndexByte(s, ':')
+		if i == -1 {
+			return "", errSourceRoute
+		}
+		for _, d := range strings.Split(s[:i], ",") {
+			if !strings.HasPrefix(d, "@") || !validDomainName(d[1:], strict) {
+				return "", errSourceRoute
+			}
+		}
+		s = s[i+1:]
+	}
+	i := strings.LastIndexByte(s, '@')
+	if i == -1 {
+		if strings.EqualFold(s, "postmaster") {
+			return s, nil
+		}
+		return "", errNoDomain
+	}
+	local, domain := s[:i], s[i+1:]
+	if !validLocalPart(local, strict) {
+		return "", errLocalPart
+	}
+	if strings.HasPrefix(domain, "[") {
+		if _, err := parseAddressLiteral(domain); err != nil {
+			return "", err
+		}
+	} else if !validDomainName(domain, strict) {
+		return "", errDomain
+	}
+	if strict && (len(local) > 64 || len(s) > 254) {
+		return "", errPathLength
+	}
+	return s, nil
+}
+
+// NormalizeAddress returns the address with its domain in lowercase. The
+// local part is left exactly as it is, since it may be case-sensitive (RFC
+// 5321 section 2.4). The server normalizes the addresses supplied with MAIL
+// and RCPT in this way.
+func NormalizeAddress(address string) string {
+	i := strings.LastIndexByte(address, '@')
+	if i == -1 {
+		return address
+	}
+	return address[:i+1] + strings.ToLower(address[i+1:])
+}
+
+// splitAddress separates the local part of an address from its domain, which
+// is empty if the address does not have one.
+func splitAddress(address string) (string, string) {
+	i := strings.LastIndexByte(address, '@')
+	if i == -1 {
+		return address, ""
+	}
+	return address[:i], address[i+1:]
+}
+
+// EqualAddresses determines whether two addresses refer to the same mailbox.
+// Local parts are compared exactly, except for "Postmaster", which is not
+// case-sensitive, and domains are compared without regard to case.
+func EqualAddresses(a, b string) bool {
+	var (
+		localA, domainA = splitAddress(a)
+		localB, domainB = splitAddress(b)
+	)
+	if !strings.EqualFold(domainA, domainB) {
+		return false
+	}
+	if strings.EqualFold(localA, "postmaster") {
+		return strings.EqualFold(localB, "postmaster")
+	}
+	return localA == localB
+}
@@ -0,0 +1,120 @@
+package smtpsrv
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAddressLiteral(t *testing.T) {
+	for _, v := range []struct {
+		literal string
+		ip      net.IP
+	}{
+		{"[192.0.2.1]", net.ParseIP("192.0.2.1")},
+		{"[IPv6:2001:db8::1]", net.ParseIP("2001:db8::1")},
+		{"[ipv6:::ffff:192.0.2.1]", net.ParseIP("::ffff:192.0.2.1")},
+		{"192.0.2.1", nil},
+		{"[300.0.2.1]", nil},
+		{"[2001:db8::1]", nil},
+		{"[IPv6:192.0.2.1]", nil},
+		{"[x-tag:content]", nil},
+	} {
+		ip, err := parseAddressLiteral(v.literal)
+		if v.ip == nil {
+			if err == nil {
+				t.Fatalf("%s should not have been accepted", v.literal)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(v.ip) {
+			t.Fatalf("%s != %s", ip, v.ip)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, v := range []struct {
+		path    string
+		mailbox string
+		strict  bool
+		lenient bool
+	}{
+		{"<>", "", true, true},
+		{"<a@example.com>", "a@example.com", true, true},
+		{"<User.Name+tag@Example.COM>", "User.Name+tag@Example.COM", true, true},
+		{"<a@[192.0.2.1]>", "a@[192.0.2.1]", true, true},
+		{"<a@[IPv6:2001:db8::1]>", "a@[IPv6:2001:db8::1]", true, true},
+		{"<@relay.example.com,@mx.example.com:a@example.com>", "a@example.com", true, true},
+		{`<"john doe"@example.com>`, `"john doe"@example.com`, true, true},
+		{`<"a\"b@c"@example.com>`, `"a\"b@c"@example.com`, true, true},
+		{"<Postmaster>", "Postmaster", true, true},
+		{"<ñ@example.com>", "ñ@example.com", true, true},
+		{"a@example.com", "a@example.com", false, true},
+		{"<a..b@example.com>", "a..b@example.com", false, true},
+		{"<a@my_host.example.com>", "a@my_host.example.com", false, true},
+		{"<a>", "", false, false},
+		{"<a@>", "", false, false},
+		{"<@a@example.com>", "", false, false},
+		{"<a@[300.0.2.1]>", "", false, false},
+		{"<a b@example.com>", "", false, false},
+		{"<a@b@example.com>", "", false, false},
+		{"<a@exa mple.com>", "", false, false},
+		{`<"a"b"@example.com>`, "", false, false},
+	} {
+		for _, strict := range []bool{true, false} {
+			valid := v.lenient
+			if strict {
+				valid = v.strict
+			}
+			m, err := parsePath(v.path, strict)
+			if !valid {
+				if err == nil {
+					t.Fatalf("%s should not have been accepted (strict: %t)", v.path, strict)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %s (strict: %t)", v.path, err, strict)
+			}
+			if m != v.mailbox {
+				t.Fatalf("%s != %s", m, v.mailbox)
+			}
+		}
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for _, v := range []struct {
+		address    string
+		normalized string
+	}{
+		{"John.Doe@Example.COM", "John.Doe@example.com"},
+		{`"A@B"@EXAMPLE.com`, `"A@B"@example.com`},
+		{"Postmaster", "Postmaster"},
+	} {
+		if n := NormalizeAddress(v.address); n != v.normalized {
+			t.Fatalf("%s != %s", n, v.normalized)
+		}
+	}
+}
+
+func TestEqualAddresses(t *testing.T) {
+	for _, v := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"a@example.com", "a@EXAMPLE.com", true},
+		{"a@example.com", "A@example.com", false},
+		{"Postmaster@example.com", "postmaster@Example.com", true},
+		{"POSTMASTER", "postmaster", true},
+		{"postmaster", "postmaster@example.com", false},
+		{"a@example.com", "a@example.org", false},
+	} {
+		if EqualAddresses(v.a, v.b) != v.equal {
+			t.Fatalf("%s and %s: expected %t", v.a, v.b, v.equal)
+		}
+	}
+}
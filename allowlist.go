@@ -0,0 +1,30 @@
+package smtpsrv
+
+// Allowlisted determines whether every recipient of the transaction trusts
+// the sender according to Config.Allowlist, in which case expensive or
+// delaying checks (such as greylisting and content filters) can be skipped.
+// When invoked from OnRcpt, the recipient being added is included. False is
+// returned if there are no recipients.
+func (c *Client) Allowlisted() bool {
+	rcpts := c.rcpts
+	if c.pending != nil {
+		rcpts = append(rcpts[:len(rcpts):len(rcpts)], c.pending)
+	}
+	for _, r := range rcpts {
+		if !r.Allowlisted {
+			return false
+		}
+	}
+	return len(rcpts) != 0
+}
+
+// Allowlisted determines whether every recipient of the message trusts the
+// sender according to Config.Allowlist.
+func (m *Message) Allowlisted() bool {
+	for _, r := range m.Recipients {
+		if !r.Allowlisted {
+			return false
+		}
+	}
+	return len(m.Recipients) != 0
+}
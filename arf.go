@@ -0,0 +1,113 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+var errNoAbuseContact = errors.New("no abuse contact for report")
+
+// AbuseReport describes a feedback report (RFC 5965) about a message that
+// was received, such as spam. Reports are generated with Format and sending
+// them is left to the application.
+type AbuseReport struct {
+	// Address the report is sent from
+	From string
+	// Address the report is sent to - if empty, LookupContact is used to find
+	// the abuse contact for SourceIP
+	To string
+	// Function used to find the abuse contact for the network that sent the
+	// message, typically using WHOIS or abuse.net
+	LookupContact func(ip net.IP) (string, error)
+	// Type of feedback - "abuse" if empty
+	FeedbackType string
+	// Name and version of the software generating the report - the name of
+	// this library if empty
+	UserAgent string
+	// IP address of the client that sent the message
+	SourceIP net.IP
+	// Time the message was received - omitted if zero
+	ArrivalDate time.Time
+	// Human-readable description included in the first part of the report
+	Text string
+}
+
+// Format generates the report for the message. The result is a complete
+// message with the original attached, ready to be sent to the abuse contact.
+func (r *AbuseReport) Format(m *Message) ([]byte, error) {
+	to := r.To
+	if len(to) == 0 {
+		if r.LookupContact == nil || r.SourceIP == nil {
+			return nil, errNoAbuseContact
+		}
+		c, err := r.LookupContact(r.SourceIP)
+		if err != nil {
+			return nil, err
+		}
+		to = c
+	}
+	var (
+		feedbackType = r.FeedbackType
+		userAgent    = r.UserAgent
+		b            bytes.Buffer
+		w            = multipart.NewWriter(&b)
+	)
+	if len(feedbackType) == 0 {
+		feedbackType = "abuse"
+	}
+	if len(userAgent) == 0 {
+		userAgent = libraryName
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", r.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: Feedback report\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=feedback-report;\r\n")
+	fmt.Fprintf(&b, "\tboundary=\"%s\"\r\n\r\n", w.Boundary())
+	// Human-readable part
+	p, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(p, "%s\r\n", r.Text)
+	// Machine-readable part
+	p, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/feedback-report"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(p, "Feedback-Type: %s\r\n", feedbackType)
+	fmt.Fprintf(p, "User-Agent: %s\r\n", userAgent)
+	fmt.Fprintf(p, "Version: 1\r\n")
+	fmt.Fprintf(p, "Original-Mail-From: <%s>\r\n", m.From)
+	for _, t := range m.To {
+		fmt.Fprintf(p, "Original-Rcpt-To: <%s>\r\n", t)
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(p, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	if r.SourceIP != nil {
+		fmt.Fprintf(p, "Source-IP: %s\r\n", r.SourceIP)
+	}
+	// Original message
+	p, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/rfc822"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(p, "%s\r\n", m.Body)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
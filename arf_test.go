@@ -0,0 +1,82 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestAbuseReport(t *testing.T) {
+	r := &AbuseReport{
+		From: testEmail1,
+		LookupContact: func(ip net.IP) (string, error) {
+			return "abuse@example.com", nil
+		},
+		SourceIP: net.ParseIP("192.0.2.1"),
+		Text:     "spam received",
+	}
+	b, err := r.Format(&Message{
+		From: testEmail2,
+		To:   []string{testEmail3},
+		Body: content,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := m.Header.Get("To"); to != "abuse@example.com" {
+		t.Fatalf("unexpected recipient %s", to)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "feedback-report" {
+		t.Fatalf("unexpected content type %s", m.Header.Get("Content-Type"))
+	}
+	var (
+		reader = multipart.NewReader(m.Body, params["boundary"])
+		types  = []string{}
+		parts  = []string{}
+	)
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, p.Header.Get("Content-Type"))
+		parts = append(parts, string(b))
+	}
+	if len(parts) != 3 || types[1] != "message/feedback-report" || types[2] != "message/rfc822" {
+		t.Fatalf("unexpected parts %v", types)
+	}
+	for _, f := range []string{
+		"Feedback-Type: abuse",
+		"Original-Mail-From: <" + testEmail2 + ">",
+		"Original-Rcpt-To: <" + testEmail3 + ">",
+		"Source-IP: 192.0.2.1",
+	} {
+		if !strings.Contains(parts[1], f) {
+			t.Fatalf("%s missing from report", f)
+		}
+	}
+	if !strings.HasPrefix(parts[2], content) {
+		t.Fatal("original message missing from report")
+	}
+	r.LookupContact = nil
+	if _, err := r.Format(&Message{}); err == nil {
+		t.Fatal("report without a contact should not have been generated")
+	}
+}
@@ -0,0 +1,329 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	errAuthCancelled = errors.New("authentication cancelled")
+	errAuthMalformed = errors.New("malformed authentication response")
+	errAuthRead      = errors.New("connection lost during authentication")
+)
+
+// authMechanism describes a SASL mechanism that may be used with AUTH. The
+// enabled function determines whether the configuration provides what the
+// mechanism needs and auth performs the exchange, returning the username on
+// success.
+type authMechanism struct {
+	name    string
+	enabled func(config *Config) bool
+	auth    func(c *Client, initial []byte) (string, error)
+}
+
+// authMechanisms lists the supported mechanisms in the order they are
+// advertised to clients.
+var authMechanisms = []*authMechanism{
+	{
+		name:    "PLAIN",
+		enabled: hasAuthenticator,
+		auth:    authPlain,
+	},
+	{
+		name:    "LOGIN",
+		enabled: hasAuthenticator,
+		auth:    authLogin,
+	},
+	{
+		name:    "CRAM-MD5",
+		enabled: hasSecretLookup,
+		auth:    authCRAMMD5,
+	},
+	{
+		name:    "XOAUTH2",
+		enabled: hasTokenValidator,
+		auth:    authXOAUTH2,
+	},
+}
+
+// hasAuthenticator determines whether a password authenticator is set.
+func hasAuthenticator(config *Config) bool {
+	return config.Authenticator != nil
+}
+
+// hasSecretLookup determines whether a shared secret lookup function is set.
+func hasSecretLookup(config *Config) bool {
+	return config.LookupSecret != nil
+}
+
+// hasTokenValidator determines whether an OAuth token validator is set.
+func hasTokenValidator(config *Config) bool {
+	return config.ValidateToken != nil
+}
+
+// authEnabled determines whether any mechanism is enabled.
+func authEnabled(config *Config) bool {
+	for _, m := range authMechanisms {
+		if m.enabled(config) {
+			return true
+		}
+	}
+	return false
+}
+
+// readAuthResponse sends a challenge to the client and decodes the response.
+// A response consisting of "*" indicates that the client wishes to cancel.
+// If the response cannot be read, errAuthRead is returned and the session
+// should end.
+func (c *Client) readAuthResponse(challenge string) ([]byte, error) {
+	c.writeReply(334, base64.StdEncoding.EncodeToString([]byte(challenge)))
+	l, err := c.readLine(maxAuthLine, c.commandTimeout())
+	if err == errLineTooLong {
+		return nil, errAuthMalformed
+	}
+	if err != nil {
+		return nil, errAuthRead
+	}
+	if bytes.Equal(l, []byte("*")) {
+		return nil, errAuthCancelled
+	}
+	b, err := base64.StdEncoding.DecodeString(string(l))
+	if err != nil {
+		return nil, errAuthMalformed
+	}
+	return b, nil
+}
+
+// validUsername determines whether the username may be recorded for the
+// session. Usernames are decoded from base64 and may contain anything, but
+// control characters would allow headers to be injected where the username
+// is recorded in the message.
+func validUsername(username string) bool {
+	return strings.IndexFunc(username, func(r rune) bool {
+		return r < ' ' || r == 0x7f
+	}) == -1
+}
+
+// authPlain implements the PLAIN mechanism (RFC 4616). The response consists
+// of an optional authorization identity, the username, and the password, each
+// separated by a NUL byte.
+func authPlain(c *Client, initial []byte) (string, error) {
+	if initial == nil {
+		r, err := c.readAuthResponse("")
+		if err != nil {
+			return "", err
+		}
+		initial = r
+	}
+	parts := bytes.Split(initial, []byte{0})
+	if len(parts) != 3 {
+		return "", errAuthMalformed
+	}
+	var (
+		identity = string(parts[0])
+		username = string(parts[1])
+		password = string(parts[2])
+	)
+	if len(identity) != 0 && identity != username {
+		return "", errAuthMalformed
+	}
+	if err := c.config.Authenticator("PLAIN", username, password); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// authLogin implements the obsolete but widely used LOGIN mechanism. The
+// username and password are requested in turn unless the username was
+// provided as the initial response.
+func authLogin(c *Client, initial []byte) (string, error) {
+	if initial == nil {
+		r, err := c.readAuthResponse("Username:")
+		if err != nil {
+			return "", err
+		}
+		initial = r
+	}
+	password, err := c.readAuthResponse("Password:")
+	if err != nil {
+		return "", err
+	}
+	username := string(initial)
+	if err := c.config.Authenticator("LOGIN", username, string(password)); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// authCRAMMD5 implements the CRAM-MD5 mechanism (RFC 2195). The client is
+// sent a unique challenge and responds with its username and the HMAC-MD5
+// digest of the challenge, keyed with the secret shared with the server.
+func authCRAMMD5(c *Client, initial []byte) (string, error) {
+	if initial != nil {
+		return "", errAuthMalformed
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return "", err
+	}
+	challenge := fmt.Sprintf("<%d.%d@%s>", n, time.Now().Unix(), c.config.Banner)
+	r, err := c.readAuthResponse(challenge)
+	if err != nil {
+		return "", err
+	}
+	i := bytes.LastIndexByte(r, ' ')
+	if i == -1 {
+		return "", errAuthMalformed
+	}
+	digest, err := hex.DecodeString(string(r[i+1:]))
+	if err != nil {
+		return "", errAuthMalformed
+	}
+	username := string(r[:i])
+	secret, err := c.config.LookupSecret(username)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(md5.New, []byte(secret))
+	h.Write([]byte(challenge))
+	if !hmac.Equal(h.Sum(nil), digest) {
+		return "", errors.New("digest mismatch")
+	}
+	return username, nil
+}
+
+// authXOAUTH2 implements the XOAUTH2 mechanism used by Google and Microsoft.
+// The response contains the username and a bearer token, separated by ^A. If
+// the token is rejected, an error is sent to the client as a challenge and
+// its (empty) response is read before failing.
+func authXOAUTH2(c *Client, initial []byte) (string, error) {
+	if initial == nil {
+		r, err := c.readAuthResponse("")
+		if err != nil {
+			return "", err
+		}
+		initial = r
+	}
+	var username, token string
+	for _, f := range bytes.Split(initial, []byte{1}) {
+		switch {
+		case bytes.HasPrefix(f, []byte("user=")):
+			username = string(f[5:])
+		case bytes.HasPrefix(f, []byte("auth=")):
+			a := bytes.SplitN(f[5:], []byte(" "), 2)
+			if len(a) != 2 || !strings.EqualFold(string(a[0]), "Bearer") {
+				return "", errAuthMalformed
+			}
+			token = string(a[1])
+		}
+	}
+	if len(username) == 0 || len(token) == 0 {
+		return "", errAuthMalformed
+	}
+	if err := c.config.ValidateToken(username, token); err != nil {
+		c.readAuthResponse(`{"status":"401","schemes":"bearer"}`)
+		return "", err
+	}
+	return username, nil
+}
+
+// authExtension returns the keyword used to advertise AUTH along with the
+// enabled mechanisms or an empty string if none are enabled. AUTH is not
+// advertised over plaintext if TLS is required or once the client has
+// authenticated, since it may only be used once per session.
+func (c *Client) authExtension() string {
+	if c.config.RequireTLS && !c.IsTLS() || len(c.session.AuthUser) != 0 {
+		return ""
+	}
+	names := []string{}
+	for _, m := range authMechanisms {
+		if m.enabled(c.config) {
+			names = append(names, m.name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return "AUTH " + strings.Join(names, " ")
+}
+
+// processAUTH authenticates the client using the requested mechanism. An
+// initial response may be supplied along with the mechanism name, with "="
+// indicating an empty response. An SMTPError returned by the authenticator
+// (454 for a temporary failure, for example) is sent to the client as-is.
+// False is returned if the connection was lost during the exchange.
+func (c *Client) processAUTH(b []byte) bool {
+	if c.config.RequireTLS && !c.IsTLS() {
+		c.reply("auth.tls-required")
+		return true
+	}
+	if len(c.session.AuthUser) != 0 {
+		c.reply("auth.active")
+		return true
+	}
+	if c.inTransaction() {
+		c.reply("auth.in-transaction")
+		return true
+	}
+	var (
+		parts   = bytes.Fields(b)
+		initial []byte
+	)
+	if len(parts) == 0 || len(parts) > 2 {
+		c.reply("auth.syntax")
+		return true
+	}
+	var mechanism *authMechanism
+	for _, m := range authMechanisms {
+		if m.enabled(c.config) && strings.EqualFold(m.name, string(parts[0])) {
+			mechanism = m
+			break
+		}
+	}
+	if mechanism == nil {
+		c.reply("auth.mechanism")
+		return true
+	}
+	if len(parts) == 2 {
+		if bytes.Equal(parts[1], []byte("=")) {
+			initial = []byte{}
+		} else {
+			r, err := base64.StdEncoding.DecodeString(string(parts[1]))
+			if err != nil {
+				c.reply("auth.malformed")
+				return true
+			}
+			initial = r
+		}
+	}
+	username, err := mechanism.auth(c, initial)
+	if err == nil && !validUsername(username) {
+		err = errAuthMalformed
+	}
+	switch err {
+	case nil:
+		c.session.AuthUser = username
+		c.reply("auth.ok")
+	case errAuthRead:
+		return false
+	case errAuthCancelled:
+		c.reply("auth.cancelled")
+	case errAuthMalformed:
+		c.reply("auth.malformed")
+	default:
+		// Failures are counted separately from other errors so that
+		// successful commands in between do not reset the count
+		c.authFailures++
+		c.rejected("auth.invalid", err)
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package smtpsrv
+
+import (
+	"strings"
+)
+
+// Calendar contains the scheduling information from a text/calendar part
+// (RFC 5545), such as a meeting invitation (RFC 6047).
+type Calendar struct {
+	// iTIP method, such as REQUEST, REPLY, or CANCEL
+	Method string
+	Events []*CalendarEvent
+}
+
+// CalendarEvent describes a single VEVENT within a calendar.
+type CalendarEvent struct {
+	UID       string
+	Summary   string
+	Organizer string
+	Attendees []*CalendarAttendee
+}
+
+// CalendarAttendee describes an attendee of an event. Address is the email
+// address of the attendee and Status is the participation status (such as
+// ACCEPTED or NEEDS-ACTION), if specified.
+type CalendarAttendee struct {
+	Address string
+	Name    string
+	Status  string
+}
+
+// unfoldCalendar splits the content of a calendar into lines, joining lines
+// that were folded by inserting a CRLF followed by whitespace.
+func unfoldCalendar(s string) []string {
+	var lines []string
+	for _, l := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n") {
+		if len(lines) != 0 && len(l) != 0 && (l[0] == ' ' || l[0] == '\t') {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// parseCalendarLine splits a content line into its name, parameters, and
+// value. Names and parameter names are converted to uppercase. Quoted
+// parameter values may contain ";" and ":".
+func parseCalendarLine(l string) (string, map[string]string, string, bool) {
+	var (
+		params = map[string]string{}
+		quoted bool
+		fields []string
+		start  int
+	)
+	for i := 0; i < len(l); i++ {
+		switch l[i] {
+		case '"':
+			quoted = !quoted
+		case ';', ':':
+			if quoted {
+				continue
+			}
+			fields = append(fields, l[start:i])
+			start = i + 1
+			if l[i] == ':' {
+				for _, f := range fields[1:] {
+					kv := strings.SplitN(f, "=", 2)
+					if len(kv) == 2 {
+						params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+					}
+				}
+				return strings.ToUpper(fields[0]), params, l[start:], true
+			}
+		}
+	}
+	return "", nil, "", false
+}
+
+// calendarAddress removes the "mailto:" prefix from a calendar address.
+func calendarAddress(v string) string {
+	if len(v) >= 7 && strings.EqualFold(v[:7], "mailto:") {
+		return v[7:]
+	}
+	return v
+}
+
+// parseCalendar extracts the method and events from a calendar. Properties
+// that are not needed are ignored.
+func parseCalendar(s string) *Calendar {
+	var (
+		c     = &Calendar{}
+		event *CalendarEvent
+	)
+	for _, l := range unfoldCalendar(s) {
+		name, params, value, ok := parseCalendarLine(l)
+		if !ok {
+			continue
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			event = &CalendarEvent{}
+			c.Events = append(c.Events, event)
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			event = nil
+		case name == "METHOD" && event == nil:
+			c.Method = strings.ToUpper(value)
+		case event == nil:
+		case name == "UID":
+			event.UID = value
+		case name == "SUMMARY":
+			event.Summary = value
+		case name == "ORGANIZER":
+			event.Organizer = calendarAddress(value)
+		case name == "ATTENDEE":
+			event.Attendees = append(event.Attendees, &CalendarAttendee{
+				Address: calendarAddress(value),
+				Name:    params["CN"],
+				Status:  strings.ToUpper(params["PARTSTAT"]),
+			})
+		}
+	}
+	return c
+}
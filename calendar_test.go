@@ -0,0 +1,65 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+var testCalendar = "BEGIN:VCALENDAR\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:1234@example.com\r\n" +
+	"SUMMARY:Planning\r\n" +
+	"ORGANIZER;CN=A:mailto:a@example.com\r\n" +
+	"ATTENDEE;CN=\"B; the second\";PARTSTAT=needs-action:mailto:b@ex\r\n" +
+	" ample.com\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseCalendar(t *testing.T) {
+	m := &Message{
+		Body: "MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/alternative; boundary=\"b\"\r\n" +
+			"\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"You have been invited.\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/calendar; method=REQUEST\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte(testCalendar)) + "\r\n" +
+			"--b--\r\n",
+	}
+	p, err := m.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.MIME.Parts) != 2 || string(p.MIME.Parts[1].Content) != testCalendar {
+		t.Fatal("calendar part not decoded")
+	}
+	c := []*Calendar{
+		{
+			Method: "REQUEST",
+			Events: []*CalendarEvent{
+				{
+					UID:       "1234@example.com",
+					Summary:   "Planning",
+					Organizer: "a@example.com",
+					Attendees: []*CalendarAttendee{
+						{
+							Address: "b@example.com",
+							Name:    "B; the second",
+							Status:  "NEEDS-ACTION",
+						},
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(p.Calendars, c) {
+		t.Fatalf("%+v != %+v", p.Calendars, c)
+	}
+}
@@ -0,0 +1,85 @@
+package smtpsrv
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConfigError lists the problems found with a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+// Error returns the problems separated by semicolons.
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// DryRun checks the configuration for problems without listening for
+// connections, returning a *ConfigError describing any that are found. It
+// can be used to validate a configuration before deploying it.
+func (c *Config) DryRun() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if _, port, err := net.SplitHostPort(c.Addr); err != nil {
+		add("address %q: %s", c.Addr, err)
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		add("address %q: %s", c.Addr, err)
+	}
+	if c.TLSConfig != nil {
+		if len(c.TLSConfig.Certificates) == 0 && c.TLSConfig.GetCertificate == nil {
+			add("TLS is configured without a certificate")
+		}
+		for i, cert := range c.TLSConfig.Certificates {
+			if len(cert.Certificate) == 0 {
+				add("TLS certificate %d is empty", i)
+				continue
+			}
+			x, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				add("TLS certificate %d: %s", i, err)
+				continue
+			}
+			if time.Now().After(x.NotAfter) {
+				add("TLS certificate %d expired on %s", i, x.NotAfter.Format(time.RFC3339))
+			}
+		}
+	} else if c.RequireTLS {
+		add("RequireTLS is set but TLS is not configured")
+	}
+	if c.RequireAuth {
+		enabled := false
+		for _, m := range authMechanisms {
+			if m.enabled(c) {
+				enabled = true
+			}
+		}
+		if !enabled {
+			add("RequireAuth is set but no authentication mechanism is enabled")
+		}
+	}
+	if c.KeepAlive != 0 && c.Handler == nil {
+		add("KeepAlive is set but has no effect without a Handler")
+	}
+	if _, ok := c.Handler.(StreamHandler); ok && c.EnforceDMARC != DMARCPolicyNone {
+		add("EnforceDMARC is set but messages sent with DATA are passed to the StreamHandler before DMARC can be evaluated")
+	}
+	for name, r := range c.Replies {
+		if _, ok := replies[name]; !ok {
+			add("unknown reply %q", name)
+			continue
+		}
+		if len(r.Enhanced) != 0 && r.Enhanced[0] != byte('0'+r.Code/100) {
+			add("reply %q: code %d does not match enhanced code %s", name, r.Code, r.Enhanced)
+		}
+	}
+	if len(problems) != 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Config{
+		Addr:      "127.0.0.1:smtp",
+		TLSConfig: tlsConfig,
+	}).DryRun(); err != nil {
+		t.Fatal(err)
+	}
+	err = (&Config{
+		Addr:        "127.0.0.1",
+		TLSConfig:   &tls.Config{},
+		RequireAuth: true,
+		Replies: map[string]Reply{
+			"rcpt.ok":  {CodeOK, "5.1.5", "ok"},
+			"xunknown": {CodeOK, "2.0.0", "ok"},
+		},
+	}).DryRun()
+	e, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(e.Problems) != 5 {
+		t.Fatalf("unexpected problems %v", e.Problems)
+	}
+	err = (&Config{
+		Addr:         "127.0.0.1:smtp",
+		TLSConfig:    tlsConfig,
+		Handler:      &streamHandler{},
+		CheckDMARC:   true,
+		EnforceDMARC: DMARCPolicyReject,
+	}).DryRun()
+	if e, ok := err.(*ConfigError); !ok || len(e.Problems) != 1 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
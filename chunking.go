@@ -0,0 +1,86 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// chunkingExtension advertises CHUNKING, which is always available.
+func (c *Client) chunkingExtension() string {
+	return "CHUNKING"
+}
+
+// binarymimeExtension advertises BINARYMIME, which is always available since
+// binary content is preserved when sent with BDAT.
+func (c *Client) binarymimeExtension() string {
+	return "BINARYMIME"
+}
+
+// processBDAT receives a chunk of the message body (RFC 3030). The chunk
+// immediately follows the command and is always read in its entirety, even
+// if it is going to be rejected, so that the client and server remain in
+// sync. The message is queued once the chunk marked LAST is received. False is
+// returned if the chunk could not be read.
+func (c *Client) processBDAT(b []byte) bool {
+	var (
+		args = bytes.Fields(b)
+		last bool
+	)
+	if len(args) == 2 && bytes.EqualFold(args[1], []byte("LAST")) {
+		last = true
+	} else if len(args) != 1 {
+		c.reply("bdat.syntax")
+		return true
+	}
+	size, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || size < 0 {
+		c.reply("bdat.size")
+		return true
+	}
+	var (
+		valid    = len(c.mailTo) != 0
+		tooLarge = c.config.MaxMessageSize != 0 &&
+			int64(c.chunks.Len())+size > c.config.MaxMessageSize
+		rejected error
+		w        = ioutil.Discard
+	)
+	// The data hook is invoked when the first chunk arrives
+	if valid && c.chunkHash == nil && c.config.OnData != nil {
+		rejected = c.config.OnData(c)
+	}
+	if valid && !tooLarge && rejected == nil {
+		if c.chunkHash == nil {
+			c.chunkHash = sha256.New()
+		}
+		w = io.MultiWriter(&c.chunks, c.chunkHash)
+	}
+	if err := c.prepareRead(c.dataBlockTimeout()); err != nil {
+		return false
+	}
+	if _, err := io.CopyN(w, c.reader, size); err != nil {
+		return false
+	}
+	switch {
+	case !valid:
+		c.reply("data.no-rcpt")
+	case rejected != nil:
+		c.abort()
+		c.rejected("data.rejected", rejected)
+	case tooLarge && last:
+		c.rejectData("data.too-large", int64(c.chunks.Len())+size)
+	case tooLarge:
+		c.abort()
+		c.reply("data.too-large")
+	case last && c.eightBitHeaderSection(c.chunks.Bytes()):
+		c.rejectData("data.8bit-headers", int64(c.chunks.Len()))
+	case last:
+		raw := append([]byte(nil), c.chunks.Bytes()...)
+		c.queueMessage(raw, string(raw), c.chunkHash.Sum(nil))
+	default:
+		c.reply("bdat.ok")
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// cidPattern matches cid: URLs (RFC 2392) within HTML, such as the value of
+// an src attribute.
+var cidPattern = regexp.MustCompile(`(?i)cid:[^"'\s<>()]+`)
+
+// PartByContentID returns the part with the specified Content-ID, which may
+// be given with or without angle brackets or as a cid: URL. Nil is returned
+// if there is no such part.
+func (p *ParsedMessage) PartByContentID(id string) *Part {
+	if len(id) >= 4 && strings.EqualFold(id[:4], "cid:") {
+		if u, err := url.QueryUnescape(id[4:]); err == nil {
+			id = u
+		} else {
+			id = id[4:]
+		}
+	}
+	id = strings.Trim(id, "<>")
+	var part *Part
+	p.MIME.Walk(func(c *Part) {
+		if part == nil && strings.Trim(strings.TrimSpace(c.Header.Get("Content-ID")), "<>") == id {
+			part = c
+		}
+	})
+	return part
+}
+
+// RewriteContentIDs replaces each cid: URL in the HTML with the value
+// returned by rewrite for the part it refers to, such as a data URI or the
+// path of a file that the part was written to. URLs that do not refer to a
+// part, or for which rewrite returns an empty string, are left unchanged.
+func (p *ParsedMessage) RewriteContentIDs(html string, rewrite func(part *Part) string) string {
+	return cidPattern.ReplaceAllStringFunc(html, func(u string) string {
+		part := p.PartByContentID(u)
+		if part == nil {
+			return u
+		}
+		if v := rewrite(part); len(v) != 0 {
+			return v
+		}
+		return u
+	})
+}
+
+// DataURI returns a data: URL (RFC 2397) containing the decoded content of
+// the part, suitable for use with RewriteContentIDs.
+func DataURI(part *Part) string {
+	return "data:" + part.ContentType + ";base64," + base64.StdEncoding.EncodeToString(part.Content)
+}
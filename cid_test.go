@@ -0,0 +1,38 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestRewriteContentIDs(t *testing.T) {
+	m := &Message{
+		Body: "MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/related; boundary=\"b\"\r\n" +
+			"\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<img src=\"cid:logo%40example.com\"><img src=\"cid:missing\">\r\n" +
+			"--b\r\n" +
+			"Content-Type: image/png\r\n" +
+			"Content-ID: <logo@example.com>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"iVBORw0KGgo=\r\n" +
+			"--b--\r\n",
+	}
+	p, err := m.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PartByContentID("<logo@example.com>") != p.MIME.Parts[1] {
+		t.Fatal("part should have been found")
+	}
+	var (
+		html = p.RewriteContentIDs(string(p.MIME.Parts[0].Content), DataURI)
+		exp  = "<img src=\"data:image/png;base64,iVBORw0KGgo=\"><img src=\"cid:missing\">"
+	)
+	if html != exp {
+		t.Fatalf("%s != %s", html, exp)
+	}
+}
@@ -3,170 +3,879 @@ package smtpsrv
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net"
-	"net/mail"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// libraryName identifies this library in the greeting and message stamp.
+const libraryName = "go-smtpsrv"
+
+// Maximum length of lines received from the client, including the CRLF
+const (
+	maxCommandLine = 512   // RFC 5321 section 4.5.3.1.4
+	maxTextLine    = 1000  // RFC 5321 section 4.5.3.1.6
+	maxAuthLine    = 12288 // RFC 4954 section 4
+)
+
+// commandLineLimits lists the commands whose lines may exceed maxCommandLine
+// because of the extensions that add parameters to them: SIZE (RFC 1870
+// section 7), DSN (RFC 3461 section 5), and AUTH (RFC 4954 sections 4 and 5).
+// Command lines are read using the largest limit and then checked against
+// the limit for the command.
+var commandLineLimits = map[string]int{
+	"AUTH": maxAuthLine,
+	"MAIL": maxCommandLine + 26 + 100 + 500,
+	"RCPT": maxCommandLine + 500,
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// allowedBeforeHelo lists the commands that may be used before the client has
+// identified itself with HELO or EHLO (or LHLO) and again after STARTTLS.
+var allowedBeforeHelo = map[string]bool{
+	"HELO": true,
+	"EHLO": true,
+	"LHLO": true,
+	"NOOP": true,
+	"RSET": true,
+	"QUIT": true,
+}
+
 // Client facilitates communication with an SMTP client. Each instance
 // maintains state for and receives commands from a single client.
 type Client struct {
-	config     *Config
-	conn       net.Conn
-	reader     *bufio.Reader
-	newMessage chan<- *Message
-	finished   chan<- *Client
-	mailFrom   string
-	mailTo     []string
+	config       *Config
+	conn         net.Conn
+	raw          net.Conn
+	session      *Session
+	sequence     uint64
+	reader       *bufio.Reader
+	writer       *bufio.Writer
+	newMessage   chan<- *Message
+	ctx          context.Context
+	heloAddr     net.IP
+	errorCount   int
+	authFailures int
+	extended     bool
+	mailFrom     string
+	mailTime     time.Time
+	mailParams   map[string]string
+	spf          SPFResult
+	mailTo       []string
+	rcpts        []*Recipient
+	pending      *Recipient
+	refusal      *refusal
+	chunks       bytes.Buffer
+	chunkHash    hash.Hash
+
+	// Used to enforce the connection limits - tooMany is set by the server
+	// if MaxConnections was reached when the client connected
+	connections *connections
+	tooMany     bool
+
+	// Used by Server.Shutdown to disconnect the client once it is idle
+	mutex        sync.Mutex
+	idle         bool
+	shuttingDown bool
 }
 
 // reset initializes all values to their defaults.
 func (c *Client) reset() {
 	c.mailFrom = ""
+	c.mailTime = time.Time{}
+	c.mailParams = nil
+	c.spf = ""
 	c.mailTo = []string{}
+	c.rcpts = nil
+	c.refusal = nil
+	c.chunks.Reset()
+	c.chunkHash = nil
 }
 
-// readLine obtains the next line from the client while observing the timeout.
-func (c *Client) readLine() ([]byte, error) {
-	if c.config.ReadTimeout != 0 {
-		c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+// inTransaction determines whether MAIL has been accepted since the
+// transaction was last reset. The sender cannot be used for this since it is
+// empty for the null reverse-path.
+func (c *Client) inTransaction() bool {
+	return !c.mailTime.IsZero()
+}
+
+// abort abandons the transaction in progress, if any, invoking OnAbort so
+// that any state kept for it by the application can be discarded.
+func (c *Client) abort() {
+	if c.inTransaction() && c.config.OnAbort != nil {
+		c.config.OnAbort(c)
 	}
-	line, isPrefix, err := c.reader.ReadLine()
-	if err != nil || isPrefix {
+	c.reset()
+}
+
+// flush sends any pending replies to the client while observing the write
+// timeout. Once a write has failed, the error is returned by every subsequent
+// call, since the client can no longer be sent anything.
+func (c *Client) flush() error {
+	if c.writer.Buffered() == 0 {
+		return nil
+	}
+	if c.config.WriteTimeout != 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+	return c.writer.Flush()
+}
+
+// prepareRead is invoked before reading from the client. Replies are held
+// back while the client has pipelined commands waiting to be processed (RFC
+// 2920) and sent together once it has none, since it may be waiting for them.
+// The timeout is then applied, if it is not zero. An error is returned if the
+// replies could not be sent, in which case the client should be
+// disconnected.
+func (c *Client) prepareRead(timeout time.Duration) error {
+	if c.reader.Buffered() == 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	if timeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// readLine obtains the next line from the client while observing the
+// timeout. If the line (including the CRLF) exceeds limit bytes, the rest of
+// it is read and discarded and errLineTooLong is returned so that the caller
+// can reply and remain in sync with the client. If the line ends in a bare LF
+// and the quirk is not tolerated, the client is sent an error and
+// disconnected.
+func (c *Client) readLine(limit int, timeout time.Duration) ([]byte, error) {
+	if err := c.prepareRead(timeout); err != nil {
 		return nil, err
 	}
-	return line, nil
+	var (
+		l []byte
+		n int
+	)
+	for {
+		line, err := c.reader.ReadSlice('\n')
+		n += len(line)
+		if n <= limit {
+			l = append(l, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// A final line without a line ending is returned as it is
+		if err != nil && (err != io.EOF || n == 0) {
+			return nil, err
+		}
+		break
+	}
+	if n > limit {
+		return nil, errLineTooLong
+	}
+	switch {
+	case bytes.HasSuffix(l, []byte("\r\n")):
+		l = l[:len(l)-2]
+	case bytes.HasSuffix(l, []byte("\n")):
+		l = l[:len(l)-1]
+		if !c.quirk(QuirkBareLF) {
+			c.reply("line.bare-lf")
+			c.flush()
+			c.conn.Close()
+			return nil, errBareLF
+		}
+	}
+	return l, nil
 }
 
-// writeReply contructs a reply from the reply code and message. The result is
-// then sent back to the client.
+// writeReply contructs a reply from the reply code and message, without an
+// enhanced status code. This is used for the greeting, the reply to HELO and
+// EHLO, and other replies that are not expected to include one. The result is
+// then sent back to the client. Messages containing newlines are sent as a
+// multi-line reply.
 func (c *Client) writeReply(code int, message string) {
-	c.conn.Write([]byte(strconv.Itoa(code) + " " + message + "\r\n"))
+	c.sendReply(Reply{Code: code, Message: message})
+}
+
+// reply looks up the named reply and sends it to the client.
+func (c *Client) reply(name string, args ...interface{}) {
+	c.sendReply(c.lookupReply(name, args...))
+}
+
+// lookupReply returns the named reply, using the one from the configuration
+// if it has been overridden. If arguments are provided, they are used to
+// format the message.
+func (c *Client) lookupReply(name string, args ...interface{}) Reply {
+	r, ok := c.config.Replies[name]
+	if !ok {
+		r = replies[name]
+	}
+	if len(args) != 0 && strings.Contains(r.Message, "%") {
+		r.Message = fmt.Sprintf(r.Message, args...)
+	}
+	return r
+}
+
+// sendReply queues the reply to be sent back to the client. Consecutive
+// replies indicating a syntax or sequence error are counted.
+func (c *Client) sendReply(r Reply) {
+	if r.Code >= CodeSyntaxError && r.Code <= CodeParamNotImplemented {
+		c.errorCount++
+	} else {
+		c.errorCount = 0
+	}
+	c.writer.WriteString(r.String() + "\r\n")
 }
 
 // writeBanner sends the initial greeting to the client. The banner supplied by
-// the caller is combined with the name of this library.
+// the caller (or the variant chosen for this connection) is combined with the
+// name of this library if requested.
 func (c *Client) writeBanner() {
-	c.writeReply(220, fmt.Sprintf("%s [go-smtpsrv]", c.config.Banner))
+	c.session.Greeting = c.greeting()
+	if c.config.Identify {
+		c.writeReply(220, fmt.Sprintf("%s [%s]", c.session.Greeting, libraryName))
+	} else {
+		c.writeReply(220, c.session.Greeting)
+	}
 }
 
-// processHELO responds to HELO or EHLO commands from the client. At this
-// point, no extensions are supported, so the reply to both commands are
-// identical. The banner used in the greeting is repeated here.
-func (c *Client) processHELO() {
-	c.reset()
+// setHelo stores the hostname provided by the client with HELO or EHLO. If an
+// address literal was provided instead, it is parsed. The client is sent an
+// error if the hostname is missing or invalid.
+func (c *Client) setHelo(b []byte) bool {
+	helo := string(bytes.TrimSpace(b))
+	if len(helo) == 0 {
+		a, ok := c.session.RemoteAddr.(*net.TCPAddr)
+		if !ok || !c.quirk(QuirkHeloWithoutHostname) {
+			c.reply("helo.missing")
+			return false
+		}
+		helo = addressLiteral(a.IP)
+	}
+	var heloAddr net.IP
+	if strings.HasPrefix(helo, "[") {
+		ip, err := parseAddressLiteral(helo)
+		if err != nil {
+			c.reply("helo.literal", err)
+			return false
+		}
+		heloAddr = ip
+	}
+	if c.config.OnHelo != nil {
+		if err := c.config.OnHelo(c, helo); err != nil {
+			c.rejected("helo.rejected", err)
+			return false
+		}
+	}
+	c.session.Helo = helo
+	c.heloAddr = heloAddr
+	return true
+}
+
+// processHELO responds to HELO commands from the client. The banner used in
+// the greeting is repeated here.
+func (c *Client) processHELO(b []byte) {
+	if !c.setHelo(b) {
+		return
+	}
+	c.abandon()
+	c.extended = false
 	c.writeReply(250, c.config.Banner)
 }
 
+// processEHLO responds to EHLO commands from the client. In addition to the
+// banner, the reply lists the extensions supported by the server.
+func (c *Client) processEHLO(b []byte) {
+	if !c.setHelo(b) {
+		return
+	}
+	c.abandon()
+	c.extended = true
+	lines := append([]string{c.config.Banner}, c.extensionLines()...)
+	c.writeReply(250, strings.Join(lines, "\n"))
+}
+
+// hasTLSConfig determines whether STARTTLS is available.
+func hasTLSConfig(config *Config) bool {
+	return config.TLSConfig != nil
+}
+
+// starttlsExtension advertises STARTTLS if TLS is configured and the
+// connection has not yet been upgraded.
+func (c *Client) starttlsExtension() string {
+	if c.config.TLSConfig == nil || c.IsTLS() {
+		return ""
+	}
+	return "STARTTLS"
+}
+
+// eightbitmimeExtension advertises 8BITMIME, which is always available since
+// message content is never modified.
+func (c *Client) eightbitmimeExtension() string {
+	return "8BITMIME"
+}
+
+// smtputf8Extension advertises SMTPUTF8 (RFC 6531), which is always
+// available.
+func (c *Client) smtputf8Extension() string {
+	return "SMTPUTF8"
+}
+
+// enhancedStatusCodesExtension advertises ENHANCEDSTATUSCODES (RFC 2034),
+// which is always available.
+func (c *Client) enhancedStatusCodesExtension() string {
+	return "ENHANCEDSTATUSCODES"
+}
+
+// pipeliningExtension advertises PIPELINING (RFC 2920), which is always
+// available.
+func (c *Client) pipeliningExtension() string {
+	return "PIPELINING"
+}
+
+// sizeExtension advertises SIZE along with the maximum message size if one
+// is set.
+func (c *Client) sizeExtension() string {
+	if c.config.MaxMessageSize == 0 {
+		return ""
+	}
+	return fmt.Sprintf("SIZE %d", c.config.MaxMessageSize)
+}
+
+// processSTARTTLS upgrades the connection to TLS. Once the handshake
+// completes, the client must start over as if it had just connected (RFC
+// 3207 section 4.2), so all state is reset.
+func (c *Client) processSTARTTLS() bool {
+	if c.IsTLS() {
+		c.reply("starttls.active")
+		return true
+	}
+	c.reply("starttls.ready")
+	if err := c.flush(); err != nil {
+		return false
+	}
+	conn := tls.Server(c.conn, c.config.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		return false
+	}
+	state := conn.ConnectionState()
+	c.conn = conn
+	c.session.TLS = &state
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
+	c.session.Helo = ""
+	c.heloAddr = nil
+	c.session.AuthUser = ""
+	c.abandon()
+	return true
+}
+
+// handshake completes the TLS handshake for connections accepted from a TLS
+// listener so that the connection state is available to OnConnect. For
+// listeners with implicit TLS, TLS begins here, after any PROXY protocol
+// header has been read. False is returned if the handshake fails.
+func (c *Client) handshake() bool {
+	if p, ok := c.conn.(*pendingTLSConn); ok {
+		c.conn = tls.Server(&bufferedConn{Conn: p.Conn, r: c.reader}, p.config)
+		c.reader = bufio.NewReader(c.conn)
+		c.writer = bufio.NewWriter(c.conn)
+	}
+	conn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	if timeout := c.greetingTimeout(); timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := conn.Handshake(); err != nil {
+		return false
+	}
+	conn.SetDeadline(time.Time{})
+	state := conn.ConnectionState()
+	c.session.TLS = &state
+	return true
+}
+
 // processMail is invoked with the address the email is being sent *from*. This
 // address might be used to indicate a failure if the message could not be sent
 // for some reason.
 func (c *Client) processMAIL(b []byte) {
+	// Ensure that the client has authenticated if required
+	if c.config.RequireAuth && len(c.session.AuthUser) == 0 {
+		c.reply("mail.auth-required")
+		return
+	}
 	// Ensure that this hasn't already been invoked
-	if len(c.mailFrom) != 0 {
-		c.writeReply(503, "MAIL already invoked")
+	if c.inTransaction() {
+		c.reply("mail.active")
 		return
 	}
 	// The next five bytes must be "FROM:"
 	if !bytes.HasPrefix(bytes.ToUpper(b), []byte("FROM:")) {
-		c.writeReply(501, "syntax: \"MAIL FROM:<address>\"")
+		c.reply("mail.syntax")
 		return
 	}
-	// Validate the address
-	a, err := mail.ParseAddress(string(b[5:]))
+	if len(b) > 5 && (b[5] == ' ' || b[5] == '\t') && !c.quirk(QuirkSpaceAfterColon) {
+		c.reply("mail.syntax")
+		return
+	}
+	// Validate the address and parameters
+	path, rawParams := splitPath(b[5:])
+	params, err := parseParams(rawParams)
+	if err != nil {
+		c.reply("param.syntax")
+		return
+	}
+	// The null reverse-path is used for bounces (RFC 5321 section 4.5.5)
+	from, err := parsePath(path, c.config.StrictAddresses)
 	if err != nil {
-		c.writeReply(501, err.Error())
+		c.reply("mail.address", err)
+		return
+	}
+	from = NormalizeAddress(from)
+	if !c.checkParams(mailParams, params) {
+		return
+	}
+	if _, ok := params["SMTPUTF8"]; !ok && !isASCII(from) {
+		c.reply("smtputf8.required")
+		return
+	}
+	if !c.checkTLSPolicy(from) {
+		c.refuseMail(from, "mail.tls-required", c.lookupReply("mail.tls-required"))
+		return
+	}
+	if !c.allowRate(RateMessage) {
+		c.refuseMail(from, "mail.too-many", c.lookupReply("mail.too-many"))
 		return
 	}
-	c.mailFrom = a.Address
-	c.writeReply(250, "ok")
+	if len(c.config.Blocklists) != 0 && c.config.BlocklistAtMail &&
+		len(c.session.AuthUser) == 0 && !c.checkBlocklists() {
+		r := c.lookupReply("mail.blocklisted", c.session.Blocklists[0])
+		c.refuseMail(from, "mail.blocklisted", r)
+		return
+	}
+	c.spf = c.checkSPF(from)
+	if c.config.OnMail != nil {
+		if err := c.config.OnMail(c, from, copyParams(params)); err != nil {
+			c.refuseMail(from, "mail.rejected", c.errorReply("mail.rejected", err))
+			return
+		}
+	}
+	c.mailFrom = from
+	c.mailTime = time.Now()
+	c.mailParams = params
+	c.reply("mail.ok")
 }
 
 // processRCPT is invoked one or more times to specify the recipient(s) of the
 // message. It may only be invoked *after* MAIL.
 func (c *Client) processRCPT(b []byte) {
 	// Ensure that MAIL has been invoked
-	if len(c.mailFrom) == 0 {
-		c.writeReply(503, "MAIL must be invoked first")
+	if !c.inTransaction() {
+		c.reply("rcpt.no-mail")
+		return
+	}
+	// The client is expected to send the remaining recipients in another
+	// transaction (RFC 5321 section 4.5.3.1.10)
+	if c.config.MaxRecipients != 0 && len(c.rcpts) >= c.config.MaxRecipients {
+		c.refuseRcpt("rcpt.too-many", c.lookupReply("rcpt.too-many"))
 		return
 	}
 	// The next three bytes must be "TO:"
 	if !bytes.HasPrefix(bytes.ToUpper(b), []byte("TO:")) {
-		c.writeReply(501, "syntax: \"RCPT TO:<address>\"")
+		c.reply("rcpt.syntax")
+		return
+	}
+	if len(b) > 3 && (b[3] == ' ' || b[3] == '\t') && !c.quirk(QuirkSpaceAfterColon) {
+		c.reply("rcpt.syntax")
 		return
 	}
-	// Validate the address
-	a, err := mail.ParseAddress(string(b[3:]))
+	// Validate the address and parameters
+	path, rawParams := splitPath(b[3:])
+	params, err := parseParams(rawParams)
 	if err != nil {
-		c.writeReply(501, err.Error())
+		c.reply("param.syntax")
+		return
+	}
+	to, err := parsePath(path, c.config.StrictAddresses)
+	if err != nil {
+		c.reply("rcpt.address", err)
+		return
 	}
-	c.mailTo = append(c.mailTo, a.Address)
-	c.writeReply(250, "ok")
+	if len(to) == 0 {
+		c.reply("rcpt.address", errNoRecipient)
+		return
+	}
+	to = NormalizeAddress(to)
+	if !c.checkParams(rcptParams, params) {
+		return
+	}
+	if _, ok := c.mailParams["SMTPUTF8"]; !ok && !isASCII(to) {
+		c.reply("smtputf8.required")
+		return
+	}
+	r := newRecipient(to, params)
+	r.Allowlisted = c.config.Allowlist != nil && c.config.Allowlist(c, c.mailFrom, to)
+	if c.config.RejectSPFFail && c.spf == SPFFail && !r.Allowlisted {
+		c.refuseRcpt("rcpt.spf-fail", c.lookupReply("rcpt.spf-fail", spfDomain(c.mailFrom, c.session.Helo)))
+		return
+	}
+	if c.config.OnRcpt != nil {
+		c.pending = r
+		err := c.config.OnRcpt(c, to, copyParams(params))
+		c.pending = nil
+		if err != nil {
+			c.refuseRcpt("rcpt.rejected", c.errorReply("rcpt.rejected", err))
+			return
+		}
+	}
+	c.mailTo = append(c.mailTo, to)
+	c.rcpts = append(c.rcpts, r)
+	c.reply("rcpt.ok")
 }
 
-// processDATA indicates that what follows is the message body
-func (c *Client) processDATA() {
-	// Ensure that there is at least one valid "to" address
-	if len(c.mailTo) == 0 {
-		c.writeReply(503, "RCPT must be invoked first")
+// deliver hands the message off to the handler or, if there is none, sends
+// it on the NewMessage channel. If a message timeout is set and the message
+// is not received in time, delivery is abandoned. Delivery is also abandoned
+// if the client is disconnected by the server.
+func (c *Client) deliver(m *Message) error {
+	if c.config.Handler != nil {
+		return c.serveMessage(m)
+	}
+	var timeout <-chan time.Time
+	if c.config.MessageTimeout != 0 {
+		t := time.NewTimer(c.config.MessageTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case c.newMessage <- m:
+		return nil
+	case <-timeout:
+		return errMessageTimeout
+	case <-c.ctx.Done():
+		return errMessageTimeout
+	}
+}
+
+// buildMessage creates a message from the current transaction with the
+// provided content, body, and checksum. The message takes ownership of the
+// slices and maps from the transaction, so the caller must reset it, which
+// replaces them rather than clearing them.
+func (c *Client) buildMessage(raw []byte, body string, checksum []byte) *Message {
+	m := &Message{
+		From:         c.mailFrom,
+		To:           c.mailTo,
+		Recipients:   c.rcpts,
+		Params:       c.mailParams,
+		SPF:          c.spf,
+		DecodeLimits: c.config.DecodeLimits,
+		Body:         body,
+		Raw:          raw,
+		Size:         int64(len(body)),
+		Helo:         c.session.Helo,
+		HeloAddr:     c.heloAddr,
+		AuthUser:     c.session.AuthUser,
+		RemoteAddr:   c.session.RemoteAddr,
+		ReceivedAt:   time.Now(),
+		QueueID:      c.queueID(),
+		Session:      c.snapshot(),
+	}
+	if c.session.TLS != nil {
+		m.TLSVersion = c.session.TLS.Version
+		m.TLSCipherSuite = c.session.TLS.CipherSuite
+	}
+	copy(m.Checksum[:], checksum)
+	if c.config.BlocklistPolicy == BlocklistTag && len(c.session.Blocklists) != 0 {
+		m.Blocklists = append([]string(nil), c.session.Blocklists...)
+	}
+	if len(c.config.TrustedRelays) != 0 && raw != nil {
+		m.OriginIP = c.originIP(body)
+	}
+	if len(c.config.MetadataPrefix) != 0 {
+		body = stripHeaders(body, c.config.MetadataPrefix)
+	}
+	m.Body = c.traceHeaders(m) + body
+	return m
+}
+
+// stampHeader returns the header added to messages if StampHeader is set.
+func (c *Client) stampHeader() string {
+	return fmt.Sprintf("%s: %s\r\n", c.config.StampHeader, libraryName)
+}
+
+// finishMessage replies to the client once delivery of the message has been
+// attempted and records the result in the journal.
+func (c *Client) finishMessage(m *Message, started time.Time, err error) {
+	switch err {
+	case nil:
+		r := c.lookupReply("data.queued", m.QueueID)
+		c.replyData(len(m.Recipients), r)
+		// The client will send the message again if it does not receive the
+		// reply, so this is recorded
+		if err := c.flush(); err != nil {
+			c.finished(m, started, "unacknowledged", "data.queued", r)
+			return
+		}
+		c.finished(m, started, "queued", "data.queued", r)
+	case errMessageTimeout:
+		r := c.lookupReply("data.timeout")
+		c.replyData(len(m.Recipients), r)
+		c.finished(m, started, "timeout", "data.timeout", r)
+	case errKeepAliveAborted:
+		// The reply can no longer indicate failure, so the connection is
+		// closed before it is completed and the client will try again
+		c.flush()
+		c.conn.Close()
+		c.finished(m, started, "failed", "data.failed", c.lookupReply("data.failed"))
+	default:
+		r := c.errorReply("data.failed", err)
+		c.replyData(len(m.Recipients), r)
+		c.finished(m, started, "failed", "data.failed", r)
+	}
+}
+
+// queueMessage creates a message from the current transaction with the
+// provided content, body, and checksum, hands it off for delivery, and
+// replies to the client. The transaction is reset in the process.
+func (c *Client) queueMessage(raw []byte, body string, checksum []byte) {
+	var (
+		m       = c.buildMessage(raw, body, checksum)
+		started = c.mailTime
+	)
+	c.reset()
+	m.DMARC = c.checkDMARC(m)
+	if m.DMARC != nil && c.config.EnforceDMARC != DMARCPolicyNone &&
+		m.DMARC.Applied >= c.config.EnforceDMARC {
+		r := c.lookupReply("data.dmarc", m.DMARC.Domain)
+		c.replyData(len(m.Recipients), r)
+		c.finished(m, started, "rejected", "data.dmarc", r)
 		return
 	}
-	// Continue to read one line at a time until the "CRLF.CRLF" sequence is
-	// found - put another way, continue until a line with only "." is
-	// encountered
-	c.writeReply(354, "continue until \\r\\n.\\r\\n")
-	lines := []string{}
+	c.finishMessage(m, started, c.deliver(m))
+}
+
+// readData reads the lines following DATA until the line containing only
+// "." is found, removing dot-stuffing (RFC 5321 section 4.5.2) and writing
+// each line followed by CRLF to w. Errors writing to w are ignored. The size
+// of the content is returned and it is written to h, both without the CRLF
+// preceding the terminating ".", which is part of the message but not of its
+// content. If the message must be rejected because it exceeds the maximum
+// size, contains a line that is too long, or contains 8-bit headers that are
+// not tolerated, the remaining lines are discarded and the name of the reply
+// rejecting it is returned.
+func (c *Client) readData(w io.Writer, h hash.Hash) (int64, string, error) {
+	var (
+		lines   int
+		size    int64
+		reject  string
+		header  = true
+		timeout = c.dataStartTimeout()
+	)
 	for {
-		l, err := c.readLine()
+		l, err := c.readLine(maxTextLine, timeout)
+		timeout = c.dataBlockTimeout()
+		if err == errLineTooLong {
+			reject = "data.line-too-long"
+			continue
+		}
 		if err != nil {
-			break
+			return 0, "", err
 		}
-		// Check for end-of-transmission and send message if found
 		if bytes.Equal(l, []byte(".")) {
-			c.newMessage <- &Message{
-				From: c.mailFrom,
-				To:   c.mailTo,
-				Body: strings.Join(lines, "\r\n"),
-			}
-			c.reset()
-			c.writeReply(250, "message queued for delivery")
-			break
+			return size, reject, nil
+		}
+		if len(l) != 0 && l[0] == '.' {
+			l = l[1:]
+		}
+		if len(l) == 0 {
+			header = false
+		}
+		if header && len(reject) == 0 && c.eightBitHeaders(l) {
+			reject = "data.8bit-headers"
+		}
+		if lines != 0 {
+			size += 2
+		}
+		lines++
+		size += int64(len(l))
+		if c.config.MaxMessageSize != 0 && size > c.config.MaxMessageSize {
+			reject = "data.too-large"
+		}
+		if len(reject) != 0 {
+			continue
+		}
+		if lines > 1 {
+			h.Write([]byte("\r\n"))
+		}
+		h.Write(l)
+		w.Write(l)
+		w.Write([]byte("\r\n"))
+	}
+}
+
+// processDATA indicates that what follows is the message body. False is
+// returned if the content could not be read, in which case the session should
+// end.
+func (c *Client) processDATA() bool {
+	// Ensure that there is at least one valid "to" address
+	if len(c.mailTo) == 0 {
+		c.reply("data.no-rcpt")
+		return true
+	}
+	// DATA cannot be mixed with BDAT in the same transaction
+	if c.chunkHash != nil {
+		c.reply("data.after-bdat")
+		return true
+	}
+	// Binary content can only be sent with BDAT (RFC 3030 section 3)
+	if strings.EqualFold(c.mailParams["BODY"], "BINARYMIME") {
+		c.reply("data.binarymime")
+		return true
+	}
+	if c.config.OnData != nil {
+		if err := c.config.OnData(c); err != nil {
+			c.rejected("data.rejected", err)
+			return true
 		}
-		lines = append(lines, string(l))
 	}
+	c.reply("data.start")
+	if h, ok := c.config.Handler.(StreamHandler); ok {
+		return c.streamData(h)
+	}
+	var (
+		raw bytes.Buffer
+		h   = sha256.New()
+	)
+	size, reject, err := c.readData(&raw, h)
+	if err != nil {
+		return false
+	}
+	if len(reject) != 0 {
+		c.rejectData(reject, size)
+		return true
+	}
+	// The CRLF preceding the terminating "." is not included in the body
+	body := raw.Bytes()
+	if len(body) != 0 {
+		body = body[:len(body)-2]
+	}
+	c.queueMessage(raw.Bytes(), string(body), h.Sum(nil))
+	return true
 }
 
-// processRSET resets all of the state variables to their initial values.
+// processRSET aborts the transaction in progress, resetting all of the state
+// variables to their initial values.
 func (c *Client) processRSET() {
-	c.reset()
-	c.writeReply(250, "ok")
+	c.abandon()
+	c.reply("rset.ok")
 }
 
 // processNOOP does absolutely nothing.
 func (c *Client) processNOOP() {
-	c.writeReply(250, "ok")
+	c.reply("noop.ok")
 }
 
 // processQUIT sends a parting message to the client.
 func (c *Client) processQUIT() {
-	c.writeReply(221, "bye")
+	c.reply("quit")
+	c.flush()
 }
 
 // run greets the client and processes each of the commands transmitted in
-// turn until either the client disconnects or QUIT is issued.
-func (c *Client) run() {
+// turn until either the client disconnects, QUIT is issued, or the context is
+// cancelled. The connection is closed when this happens.
+func (c *Client) run(ctx context.Context) {
+	var (
+		conn = c.conn
+		done = make(chan bool)
+	)
 	defer func() {
-		c.finished <- c
+		close(done)
+		c.conn.Close()
+		c.abandon()
 	}()
+	// Disconnect the client if the context is cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	c.ctx = ctx
+	if c.config.ProxyProtocol && !c.readProxyHeader() {
+		return
+	}
+	if !c.acquireConnection() {
+		return
+	}
+	defer c.releaseConnection()
+	if !c.handshake() {
+		return
+	}
+	if len(c.config.Blocklists) != 0 && !c.config.BlocklistAtMail &&
+		!c.checkBlocklists() {
+		c.reply("connect.blocklisted", c.session.Blocklists[0])
+		c.flush()
+		return
+	}
+	if c.config.OnConnect != nil {
+		if err := c.config.OnConnect(c); err != nil {
+			c.rejected("connect.rejected", err)
+			c.flush()
+			return
+		}
+	}
+	if !c.pause() {
+		return
+	}
 	c.writeBanner()
+	timeout := c.greetingTimeout()
 	for {
-		l, err := c.readLine()
+		// Clients that keep sending invalid commands are disconnected
+		if c.config.MaxErrors != 0 && (c.errorCount >= c.config.MaxErrors ||
+			c.authFailures >= c.config.MaxErrors) {
+			c.reply("errors.too-many")
+			c.flush()
+			return
+		}
+		if !c.setIdle(true) {
+			c.reply("shutdown")
+			c.flush()
+			return
+		}
+		l, err := c.readLine(maxAuthLine, timeout)
+		timeout = c.commandTimeout()
+		if !c.setIdle(false) {
+			c.reply("shutdown")
+			c.flush()
+			return
+		}
+		if err == errLineTooLong {
+			c.reply("line.too-long")
+			continue
+		}
 		if err != nil {
 			return
 		}
+		if !c.allowRate(RateCommand) {
+			c.reply("commands.too-many")
+			c.flush()
+			return
+		}
+		if !c.pause() {
+			return
+		}
 		var (
 			lineParts = bytes.SplitN(l, []byte(" "), 2)
 			cmd       = bytes.ToUpper(bytes.TrimSpace(lineParts[0]))
@@ -175,42 +884,73 @@ func (c *Client) run() {
 		if len(lineParts) > 1 {
 			param = lineParts[1]
 		}
-		switch string(cmd) {
-		case "HELO", "EHLO":
-			c.processHELO()
-		case "MAIL":
-			c.processMAIL(param)
-		case "RCPT":
-			c.processRCPT(param)
-		case "DATA":
-			c.processDATA()
-		case "RSET":
-			c.processRSET()
-		case "NOOP":
-			c.processNOOP()
-		case "QUIT":
-			c.processQUIT()
-			c.conn.Close()
+		limit, ok := commandLineLimits[string(cmd)]
+		if !ok {
+			limit = maxCommandLine
+		}
+		if len(l)+2 > limit {
+			c.reply("line.too-long")
+			continue
+		}
+		// Most commands require the client to identify itself first, and
+		// once STARTTLS completes, it must start over with EHLO
+		if len(c.session.Helo) == 0 && !allowedBeforeHelo[string(cmd)] {
+			if _, ok := lookupCommand(c.config, string(cmd)); !ok {
+				c.processUnknown(string(cmd), param)
+			} else if c.IsTLS() {
+				c.reply("helo.required")
+			} else {
+				c.reply("helo.first", c.helloCommand())
+			}
+			continue
+		}
+		command, ok := lookupCommand(c.config, string(cmd))
+		if !ok {
+			c.processUnknown(string(cmd), param)
+			continue
+		}
+		if !command.process(c, param) {
 			return
-		default:
-			c.writeReply(502, "unsupported command")
 		}
 	}
 }
 
-// NewClient creates a new Client instance for interacting with an SMTP client
-// using the provided connection.
-func NewClient(config *Config, newMessage chan<- *Message, finished chan<- *Client, conn net.Conn) *Client {
-	c := &Client{
+// newClient creates a new Client instance for interacting with an SMTP client
+// using the provided connection. The caller is responsible for invoking run.
+// The connection beneath any TLS layer is kept so that its read side can be
+// closed during shutdown.
+func newClient(config *Config, newMessage chan<- *Message, conn net.Conn) *Client {
+	raw := conn
+	if p, ok := conn.(*pendingTLSConn); ok {
+		raw = p.Conn
+	}
+	return &Client{
 		config:     config,
 		conn:       conn,
+		raw:        raw,
+		session:    newSession(conn),
 		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
 		newMessage: newMessage,
-		finished:   finished,
 		mailTo:     []string{},
 	}
-	go c.run()
-	return c
+}
+
+// RemoteAddr returns the address of the client.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr
+}
+
+// IsTLS determines whether the connection has been upgraded with STARTTLS.
+func (c *Client) IsTLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
+// AuthUser returns the username the client authenticated with or an empty
+// string if it has not authenticated.
+func (c *Client) AuthUser() string {
+	return c.session.AuthUser
 }
 
 // Close immediately disconnects the socket.
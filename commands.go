@@ -0,0 +1,211 @@
+package smtpsrv
+
+import (
+	"strings"
+)
+
+// command describes a command understood by the server. The syntax is shown
+// in response to HELP and process handles the command, returning false if the
+// session should end. If enabled is set, it determines whether the command is
+// available with the configuration.
+type command struct {
+	name    string
+	syntax  string
+	enabled func(config *Config) bool
+	process func(c *Client, param []byte) bool
+}
+
+// commands is the dispatch table used for each line received from the
+// client. Commands are listed by HELP in the order they appear here.
+var commands = []*command{
+	{
+		name:    "HELO",
+		syntax:  "HELO hostname",
+		enabled: isSMTP,
+		process: func(c *Client, param []byte) bool {
+			c.processHELO(param)
+			return true
+		},
+	},
+	{
+		name:    "EHLO",
+		syntax:  "EHLO hostname",
+		enabled: isSMTP,
+		process: func(c *Client, param []byte) bool {
+			c.processEHLO(param)
+			return true
+		},
+	},
+	{
+		name:    "LHLO",
+		syntax:  "LHLO hostname",
+		enabled: isLMTP,
+		process: func(c *Client, param []byte) bool {
+			c.processLHLO(param)
+			return true
+		},
+	},
+	{
+		name:    "STARTTLS",
+		syntax:  "STARTTLS",
+		enabled: hasTLSConfig,
+		process: func(c *Client, param []byte) bool {
+			return c.processSTARTTLS()
+		},
+	},
+	{
+		name:    "AUTH",
+		syntax:  "AUTH mechanism [initial-response]",
+		enabled: authEnabled,
+		process: func(c *Client, param []byte) bool {
+			return c.processAUTH(param)
+		},
+	},
+	{
+		name:   "MAIL",
+		syntax: "MAIL FROM:<address> [parameters]",
+		process: func(c *Client, param []byte) bool {
+			c.processMAIL(param)
+			return true
+		},
+	},
+	{
+		name:   "RCPT",
+		syntax: "RCPT TO:<address> [parameters]",
+		process: func(c *Client, param []byte) bool {
+			c.processRCPT(param)
+			return true
+		},
+	},
+	{
+		name:   "DATA",
+		syntax: "DATA",
+		process: func(c *Client, param []byte) bool {
+			return c.processDATA()
+		},
+	},
+	{
+		name:   "BDAT",
+		syntax: "BDAT size [LAST]",
+		process: func(c *Client, param []byte) bool {
+			return c.processBDAT(param)
+		},
+	},
+	{
+		name:   "RSET",
+		syntax: "RSET",
+		process: func(c *Client, param []byte) bool {
+			c.processRSET()
+			return true
+		},
+	},
+	{
+		name:   "NOOP",
+		syntax: "NOOP",
+		process: func(c *Client, param []byte) bool {
+			c.processNOOP()
+			return true
+		},
+	},
+	{
+		name:    "VRFY",
+		syntax:  "VRFY string",
+		enabled: hasVerifyAddress,
+		process: func(c *Client, param []byte) bool {
+			c.processVRFY(param)
+			return true
+		},
+	},
+	{
+		name:    "EXPN",
+		syntax:  "EXPN string",
+		enabled: hasExpandList,
+		process: func(c *Client, param []byte) bool {
+			c.processEXPN(param)
+			return true
+		},
+	},
+	{
+		name:   "HELP",
+		syntax: "HELP [command]",
+		process: func(c *Client, param []byte) bool {
+			c.processHELP(param)
+			return true
+		},
+	},
+	{
+		name:   "QUIT",
+		syntax: "QUIT",
+		process: func(c *Client, param []byte) bool {
+			c.processQUIT()
+			return false
+		},
+	},
+}
+
+// commandIndex and commandNames are built from the dispatch table when the
+// package is initialized, since HELP cannot refer to the table directly.
+var (
+	commandIndex = map[string]*command{}
+	commandNames []string
+)
+
+// lookupCommand finds the command with the specified name if it is available
+// with the configuration.
+func lookupCommand(config *Config, name string) (*command, bool) {
+	cmd, ok := commandIndex[name]
+	if !ok || cmd.enabled != nil && !cmd.enabled(config) {
+		return nil, false
+	}
+	return cmd, true
+}
+
+func init() {
+	for _, cmd := range commands {
+		commandIndex[cmd.name] = cmd
+		commandNames = append(commandNames, cmd.name)
+	}
+}
+
+// processHELP lists the commands and extensions available to the client or
+// shows the syntax of a single command.
+func (c *Client) processHELP(b []byte) {
+	name := strings.ToUpper(strings.TrimSpace(string(b)))
+	if len(name) != 0 {
+		cmd, ok := lookupCommand(c.config, name)
+		if !ok {
+			c.reply("help.unknown", name)
+			return
+		}
+		c.reply("help", cmd.syntax)
+		return
+	}
+	keywords := []string{}
+	for _, l := range c.extensionLines() {
+		if f := strings.Fields(l); len(f) != 0 {
+			keywords = append(keywords, f[0])
+		}
+	}
+	names := []string{}
+	for _, n := range commandNames {
+		if _, ok := lookupCommand(c.config, n); ok {
+			names = append(names, n)
+		}
+	}
+	lines := []string{"Commands: " + strings.Join(names, " ")}
+	if len(keywords) != 0 {
+		lines = append(lines, "Extensions: "+strings.Join(keywords, " "))
+	}
+	c.reply("help", strings.Join(lines, "\n"))
+}
+
+// processUnknown responds to a command that is not recognized (or is not
+// available with the configuration). If UnknownCommand is set, it provides
+// the reply, which allows proprietary commands to be tolerated or recorded.
+func (c *Client) processUnknown(name string, param []byte) {
+	if c.config.UnknownCommand != nil {
+		c.sendReply(c.config.UnknownCommand(c, name, string(param)))
+		return
+	}
+	c.reply("command.unknown")
+}
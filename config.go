@@ -1,6 +1,9 @@
 package smtpsrv
 
 import (
+	"crypto/tls"
+	"io"
+	"net"
 	"time"
 )
 
@@ -8,8 +11,212 @@ import (
 type Config struct {
 	// Address to listen on for new connections
 	Addr string
+	// Additional addresses to listen on, each of which may use implicit TLS
+	// and its own configuration - only used by NewServer
+	Listeners []*Listener
 	// Banner to display to new clients
 	Banner string
-	// Timeout for calls to Read()
+	// Variants of the banner used in the greeting, one of which is chosen for
+	// each connection in turn (or by address if GreetingByAddress is set) and
+	// recorded in its session - empty to always use Banner
+	Greetings []string
+	// Choose the greeting by a hash of the client's IP address so that each
+	// client always receives the same one
+	GreetingByAddress bool
+	// Include the name of this library in the banner
+	Identify bool
+	// Name of a header (such as "X-Received-By") added to each message to
+	// identify this library - empty to disable
+	StampHeader string
+	// Prefix (such as "X-SMTPSrv-") of the names of headers added to each
+	// message to record the client's IP address, HELO hostname, TLS cipher
+	// suite, authenticated user, and the address it connected to - headers
+	// with the same prefix sent by the client are removed (from Body but not
+	// Raw) so that downstream systems can trust them - empty to disable
+	MetadataPrefix string
+	// Generator used to assign queue IDs to messages (such as QueueIDULID) -
+	// nil for QueueIDHex
+	QueueIDs IDGenerator
+	// Prepend a Received header (RFC 5321 section 4.4) to each message, which
+	// uses Banner as the name of this server
+	Received bool
+	// Networks containing relays (such as internal servers) whose Received
+	// headers are trusted, used to find the address of the client that
+	// originally submitted each message (see Message.OriginIP)
+	TrustedRelays []*net.IPNet
+	// Expect each connection to begin with a PROXY protocol header (version 1
+	// or 2) and use the address it contains as the address of the client
+	ProxyProtocol bool
+	// Maximum number of clients connected at once, beyond which new clients
+	// are sent 421 and disconnected (or, if QueueConnections is set, are not
+	// accepted until another client disconnects) - 0 for no limit
+	MaxConnections   int
+	QueueConnections bool
+	// Maximum number of clients connected at once from a single IP address
+	// (as supplied by the PROXY protocol header, if enabled), beyond which
+	// new clients from it are sent 421 and disconnected - 0 for no limit
+	MaxConnectionsPerIP int
+	// Number of goroutines that serve clients, each of which serves one
+	// client at a time while the others wait in a queue of the same size -
+	// once it is full, no more connections are accepted until a worker is
+	// free - 0 to serve each client in its own goroutine
+	Workers int
+	// Limiter for the rate at which each client IP address may send commands
+	// (beyond which it is sent 421 and disconnected) and messages (beyond
+	// which MAIL is refused with 450), such as one created by NewRateLimiter
+	// - nil for no limit
+	RateLimiter RateLimiter
+	// DNS blocklists (such as "zen.spamhaus.org") on which the client's IP
+	// address is looked up when it connects, or when it sends MAIL if
+	// BlocklistAtMail is set (in which case authenticated clients are not
+	// looked up), and what to do if it is listed
+	Blocklists      []string
+	BlocklistAtMail bool
+	BlocklistPolicy BlocklistPolicy
+	// Check the client's IP address against the SPF record of the sender's
+	// domain (RFC 7208) when MAIL is received from a client that has not
+	// authenticated, and optionally reject recipients with 550 if the result
+	// is "fail" - recipients allowlisted for the sender are accepted anyway
+	CheckSPF      bool
+	RejectSPFFail bool
+	// Evaluate the DMARC record of the domain in the From header of each
+	// message from a client that has not authenticated (RFC 7489), using the
+	// SPF result from CheckSPF and the domains of any valid DKIM signatures
+	// returned by VerifyDKIM, and refuse messages with 550 once the data has
+	// been received if the policy applied to them is at least as strict as
+	// EnforceDMARC - DMARCPolicyNone to only record the result
+	CheckDMARC   bool
+	VerifyDKIM   func(m *Message) []string
+	EnforceDMARC DMARCPolicy
+	// Function that returns the organizational domain of a domain using the
+	// Public Suffix List (publicsuffix.EffectiveTLDPlusOne from
+	// golang.org/x/net, for example) - nil for strict DMARC alignment
+	OrganizationalDomain func(domain string) string
+	// Resolver used for DNS lookups, such as a *DNSCache shared between
+	// servers - nil for net.DefaultResolver
+	Resolver Resolver
+	// Function used to determine how long to wait before greeting the client
+	// and before processing each command, which allows clients with a poor
+	// reputation to be slowed down - nil or zero for no delay
+	Pace func(c *Client) time.Duration
+	// Number of consecutive syntax or sequence errors (replies from 500 to
+	// 504), or of failed AUTH attempts in total, after which the client is
+	// sent 421 and disconnected - 0 for no limit
+	MaxErrors int
+	// Timeouts for reading from the client while waiting for the first
+	// command, for each subsequent command, for the first line of content
+	// after DATA, and for each subsequent line (or BDAT chunk) - zero to use
+	// ReadTimeout or, if it is not set, the values recommended by RFC 5321
+	// section 4.5.3.2 (5, 5, 2, and 3 minutes), and negative for no limit
+	GreetingTimeout  time.Duration
+	CommandTimeout   time.Duration
+	DataStartTimeout time.Duration
+	DataBlockTimeout time.Duration
+	// Timeout used for any of the above that is not set
 	ReadTimeout time.Duration
+	// Timeout for sending replies to the client, after which it is
+	// disconnected - 0 for no limit
+	WriteTimeout time.Duration
+	// Maximum size of a message in bytes - 0 for no limit
+	MaxMessageSize int64
+	// Limits on the decoded content of messages, which Parse applies to
+	// each message and filters can apply to attachments they decompress -
+	// nil to only limit the nesting depth of parts
+	DecodeLimits *DecodeLimits
+	// Maximum number of recipients of a message - 0 for no limit
+	MaxRecipients int
+	// Handler that receives messages in place of NewMessage - nil to use the
+	// channel
+	Handler Handler
+	// Interval at which continuation lines ("250-") are sent while Handler is
+	// processing a message so that the client does not time out - if the
+	// handler then fails, the client is disconnected since the reply can no
+	// longer indicate failure - zero to disable (always disabled for LMTP)
+	KeepAlive time.Duration
+	// Maximum time to wait for a message to be received from NewMessage or
+	// handled by Handler, after which the client is sent 451 - the handler's
+	// context expires at the same time and it is abandoned if it does not
+	// return
+	MessageTimeout time.Duration
+	// Writer that receives a JSON object describing each completed transaction
+	// on its own line - it must be safe for concurrent use and is responsible
+	// for any rotation - nil disables the journal
+	Journal io.Writer
+	// TLS configuration used for STARTTLS - nil disables the extension
+	TLSConfig *tls.Config
+	// Function used to verify credentials supplied with AUTH - nil disables
+	// the PLAIN and LOGIN mechanisms
+	Authenticator func(mechanism, username, password string) error
+	// Function used to retrieve the secret shared with a user for CRAM-MD5 -
+	// nil disables the mechanism
+	LookupSecret func(username string) (string, error)
+	// Function used to validate OAuth bearer tokens supplied with XOAUTH2 -
+	// nil disables the mechanism
+	ValidateToken func(username, token string) error
+	// Function used to determine whether a recipient trusts the sender (such
+	// as a correspondent in their address book) - a transaction in which
+	// every recipient does is not slowed down by Pace and is reported by
+	// Client.Allowlisted so that hooks can skip checks such as greylisting -
+	// nil trusts no one
+	Allowlist func(c *Client, from, to string) bool
+	// Function used to answer VRFY - the reply may confirm the address, reject
+	// it, or use ReplyCannotVerify() to avoid disclosing it - nil disables the
+	// command
+	VerifyAddress func(c *Client, address string) Reply
+	// Function used to answer EXPN with the members of a mailing list, one per
+	// line of the reply message - nil disables the command
+	ExpandList func(c *Client, list string) Reply
+	// Functions invoked at each stage of a session - if one returns an error,
+	// the client is sent a rejection (or the reply from an SMTPError) instead
+	// of proceeding and a client rejected by OnConnect is disconnected -
+	// OnData is invoked when DATA or the first BDAT chunk is received and the
+	// parameters passed to OnMail and OnRcpt are copies
+	OnConnect func(c *Client) error
+	OnHelo    func(c *Client, hostname string) error
+	OnMail    func(c *Client, from string, params map[string]string) error
+	OnRcpt    func(c *Client, to string, params map[string]string) error
+	OnData    func(c *Client) error
+	// Function invoked when a transaction is abandoned before a message is
+	// accepted - by RSET, HELO, EHLO, STARTTLS, a rejected message, or the
+	// client disconnecting - so that any state kept for it can be discarded
+	OnAbort func(c *Client)
+	// Function invoked once each transaction has ended, whether a message
+	// was accepted or not, with a copy of the message that has its
+	// Disposition set - the copy shares its values with the message passed
+	// to the handler, so it must not be modified, and if the transaction
+	// ended before the content was received (because MAIL was refused or
+	// the client sent RSET, for example), the message has no content
+	OnFinish func(c *Client, m *Message)
+	// Function used to reply to commands that are not recognized, which
+	// receives the command (in uppercase) and its parameter - the reply may
+	// accept the command, or use ReplyCommandUnrecognized() (500) or
+	// ReplyCommandNotImplemented() (502) to reject it - nil sends the
+	// "command.unknown" reply (502 by default)
+	UnknownCommand func(c *Client, command, param string) Reply
+	// Function used to modify the list of extensions advertised to a client in
+	// response to EHLO, which only affects what is advertised - nil
+	// advertises the default list
+	Extensions func(c *Client, extensions []string) []string
+	// Replies to use in place of the defaults, keyed by name (see replies in
+	// reply.go for the names and default values)
+	Replies map[string]Reply
+	// Speak LMTP (RFC 2033) instead of SMTP - clients must use LHLO and
+	// receive a reply for each recipient once the message has been received
+	LMTP bool
+	// Policy for mail from each sender domain (in lowercase), used to reject
+	// mail from domains that require TLS when it arrives without it - nil
+	// accepts mail from any domain without TLS
+	SenderTLSPolicy map[string]TLSPolicy
+	// Deviations from the standards tolerated from clients, which are
+	// otherwise refused - 0 for DefaultQuirks (which are those accepted by
+	// earlier versions) or QuirkNone to tolerate none of them
+	Quirks Quirk
+	// Reject envelope addresses that do not conform exactly to RFC 5321, such
+	// as those not enclosed in angle brackets or with consecutive dots in the
+	// local part - by default, these are accepted since some clients send them
+	StrictAddresses bool
+	// Reject AUTH until the connection has been upgraded with STARTTLS
+	RequireTLS bool
+	// Reject MAIL until the client has authenticated
+	RequireAuth bool
 }
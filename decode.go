@@ -0,0 +1,120 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// minRatioSize is the decoded size below which the ratio limit is not
+// applied, since small parts can have large ratios without being harmful.
+const minRatioSize = 64 * 1024
+
+// decodeChunkSize is the amount of content decoded between checks of the
+// limits.
+const decodeChunkSize = 1024 * 1024
+
+// DecodeLimits protects against content that expands enormously when it is
+// decoded or decompressed, such as deeply nested MIME parts or zip bombs.
+// Parse applies them to the MIME structure of a message, and filters that
+// decompress attachments can apply them with Check.
+type DecodeLimits struct {
+	// Maximum size of decoded content relative to its encoded size, applied
+	// once a part exceeds 64 KiB - 0 for no limit
+	MaxRatio int
+	// Maximum depth to which parts (or archives) may be nested - 0 for 10
+	MaxDepth int
+	// Maximum total size of the decoded content - 0 for no limit
+	MaxSize int64
+}
+
+// DecodeError indicates that content exceeded one of the DecodeLimits. It can
+// be returned from a handler or hook as-is to reject the message with 554
+// 5.6.0.
+type DecodeError struct {
+	// Limit that was exceeded - "depth", "ratio", or "size"
+	Limit string
+	// Media type of the part in which the limit was exceeded
+	ContentType string
+}
+
+// Error describes the limit that was exceeded.
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoded content exceeds %s limit in %s part", e.Limit, e.ContentType)
+}
+
+// maxDepth returns the nesting depth limit.
+func (l *DecodeLimits) maxDepth() int {
+	if l == nil || l.MaxDepth == 0 {
+		return maxPartDepth
+	}
+	return l.MaxDepth
+}
+
+// Check determines whether content of the specified media type, nested at
+// the specified depth and decoded from encoded to decoded bytes, is within
+// the limits, returning a *DecodeError if it is not. A nil *DecodeLimits
+// only limits the depth.
+func (l *DecodeLimits) Check(contentType string, depth int, encoded, decoded int64) error {
+	e := &DecodeError{ContentType: contentType}
+	switch {
+	case depth > l.maxDepth():
+		e.Limit = "depth"
+	case l == nil:
+		return nil
+	case l.MaxSize != 0 && decoded > l.MaxSize:
+		e.Limit = "size"
+	case l.MaxRatio != 0 && decoded > minRatioSize &&
+		decoded > encoded*int64(l.MaxRatio):
+		e.Limit = "ratio"
+	default:
+		return nil
+	}
+	return e
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decoder tracks the content decoded while parsing a message so that the
+// size limit applies to the message as a whole.
+type decoder struct {
+	limits *DecodeLimits
+	total  int64
+}
+
+// read reads the decoded content of a part in chunks, checking the limits
+// after each one so that decoding stops soon after one is exceeded.
+func (d *decoder) read(contentType string, depth int, encoded *countingReader, r io.Reader) ([]byte, error) {
+	if d.limits == nil || d.limits.MaxSize == 0 && d.limits.MaxRatio == 0 {
+		return ioutil.ReadAll(r)
+	}
+	var b []byte
+	for {
+		chunk, err := ioutil.ReadAll(io.LimitReader(r, decodeChunkSize))
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+		n := int64(len(b))
+		if err := d.limits.Check(contentType, depth, encoded.n, n); err != nil {
+			return nil, err
+		}
+		if d.limits.MaxSize != 0 && d.total+n > d.limits.MaxSize {
+			return nil, &DecodeError{Limit: "size", ContentType: contentType}
+		}
+		if len(chunk) < decodeChunkSize {
+			d.total += n
+			return b, nil
+		}
+	}
+}
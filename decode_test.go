@@ -0,0 +1,70 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// nestedMessage returns a message with multipart parts nested to the
+// specified depth.
+func nestedMessage(depth int) string {
+	var b strings.Builder
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"b0\"\r\n\r\n")
+	for i := 1; i <= depth; i++ {
+		b.WriteString("--b" + strconv.Itoa(i-1) + "\r\n")
+		b.WriteString("Content-Type: multipart/mixed; boundary=\"b" + strconv.Itoa(i) + "\"\r\n\r\n")
+	}
+	b.WriteString("--b" + strconv.Itoa(depth) + "\r\n\r\ntext\r\n")
+	for i := depth; i >= 0; i-- {
+		b.WriteString("--b" + strconv.Itoa(i) + "--\r\n")
+	}
+	return b.String()
+}
+
+func TestDecodeLimitsDepth(t *testing.T) {
+	m := &Message{Body: nestedMessage(3)}
+	if _, err := m.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	m.DecodeLimits = &DecodeLimits{MaxDepth: 2}
+	_, err := m.Parse()
+	if e, ok := err.(*DecodeError); !ok || e.Limit != "depth" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestDecodeLimitsSize(t *testing.T) {
+	content := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 1000)))
+	m := &Message{
+		Body: "Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Transfer-Encoding: base64\r\n\r\n" + content + "\r\n" +
+			"--b\r\nContent-Transfer-Encoding: base64\r\n\r\n" + content + "\r\n" +
+			"--b--\r\n",
+		DecodeLimits: &DecodeLimits{MaxSize: 1500},
+	}
+	_, err := m.Parse()
+	if e, ok := err.(*DecodeError); !ok || e.Limit != "size" || e.ContentType != "text/plain" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	m.DecodeLimits.MaxSize = 2000
+	if _, err := m.Parse(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeLimitsCheck(t *testing.T) {
+	var l *DecodeLimits
+	if err := l.Check("application/zip", 1, 1, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	l = &DecodeLimits{MaxRatio: 100}
+	if err := l.Check("application/zip", 1, 1, 1000); err != nil {
+		t.Fatal(err)
+	}
+	err := l.Check("application/zip", 1, 1024, 1<<20)
+	if e, ok := err.(*DecodeError); !ok || e.Limit != "ratio" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package smtpsrv
+
+import (
+	"strings"
+	"time"
+)
+
+// Disposition is the outcome of a transaction in a form suited to analysis.
+// It is "accepted" if the message was accepted, or else "rejected:" or
+// "deferred:" (for temporary failures) followed by a reason code, which is
+// the name of the reply in the reply table (see Config.Replies) - such as
+// "rejected:data.too-large" or "deferred:data.timeout". Errors returned by
+// the handler use "data.failed" whether they are temporary or not.
+type Disposition string
+
+const (
+	// DispositionAccepted is the disposition of an accepted message.
+	DispositionAccepted Disposition = "accepted"
+	// DispositionAbandoned is the disposition of a transaction that the
+	// client ended (with RSET or by disconnecting, for example) before
+	// sending a message, having had at least one recipient accepted.
+	DispositionAbandoned Disposition = "abandoned"
+)
+
+// refusal is a reply that refused a recipient, which becomes the disposition
+// of the transaction if every recipient is refused.
+type refusal struct {
+	name  string
+	reply Reply
+}
+
+// newDisposition returns the disposition of a transaction ended by the named
+// reply.
+func newDisposition(name string, r Reply) Disposition {
+	switch {
+	case r.Code < 400:
+		return DispositionAccepted
+	case r.Code < 500:
+		return Disposition("deferred:" + name)
+	}
+	return Disposition("rejected:" + name)
+}
+
+// Accepted determines whether the message was accepted.
+func (d Disposition) Accepted() bool {
+	return d == DispositionAccepted
+}
+
+// Deferred determines whether the message was refused temporarily, so the
+// client is expected to send it again later.
+func (d Disposition) Deferred() bool {
+	return strings.HasPrefix(string(d), "deferred:")
+}
+
+// Reason returns the reason code of a message that was refused or an empty
+// string if it was accepted or abandoned.
+func (d Disposition) Reason() string {
+	if i := strings.IndexByte(string(d), ':'); i != -1 {
+		return string(d[i+1:])
+	}
+	return ""
+}
+
+// finished records the outcome of a transaction ended by the named reply.
+func (c *Client) finished(m *Message, started time.Time, result, name string, r Reply) {
+	c.record(m, started, result, newDisposition(name, r))
+}
+
+// record adds the disposition of a transaction to the journal and passes it
+// to OnFinish. The message may already have been delivered, so OnFinish
+// receives a copy of it with the disposition set.
+func (c *Client) record(m *Message, started time.Time, result string, d Disposition) {
+	c.journal(m, started, result, d)
+	if c.config.OnFinish != nil {
+		f := *m
+		f.Disposition = d
+		c.config.OnFinish(c, &f)
+	}
+}
+
+// transactionMessage returns a message without content describing the
+// transaction in progress, for transactions that end without one being
+// delivered.
+func (c *Client) transactionMessage(size int64) *Message {
+	m := c.buildMessage(nil, "", nil)
+	m.Body = ""
+	m.Size = size
+	return m
+}
+
+// rejectData ends a transaction whose content was rejected with the named
+// reply after size bytes were received.
+func (c *Client) rejectData(name string, size int64) {
+	var (
+		m       = c.transactionMessage(size)
+		started = c.mailTime
+		r       = c.lookupReply(name)
+	)
+	c.abort()
+	c.replyData(len(m.Recipients), r)
+	c.finished(m, started, "rejected", name, r)
+}
+
+// refuseMail refuses MAIL with the named reply r, recording the refusal as a
+// transaction from the sender that ended before it began.
+func (c *Client) refuseMail(from, name string, r Reply) {
+	c.sendReply(r)
+	m := c.transactionMessage(0)
+	m.From = from
+	c.finished(m, time.Now(), "rejected", name, r)
+}
+
+// refuseRcpt refuses a recipient with the named reply r. If no recipient is
+// accepted, this becomes the disposition of the transaction.
+func (c *Client) refuseRcpt(name string, r Reply) {
+	c.sendReply(r)
+	c.refusal = &refusal{name, r}
+}
+
+// abandon ends the transaction in progress, if any, before a message was
+// received. It is recorded as refused if every recipient was refused and as
+// abandoned otherwise.
+func (c *Client) abandon() {
+	if !c.inTransaction() {
+		return
+	}
+	var (
+		m       = c.transactionMessage(int64(c.chunks.Len()))
+		started = c.mailTime
+		f       = c.refusal
+	)
+	c.abort()
+	if len(m.Recipients) == 0 && f != nil {
+		c.finished(m, started, "rejected", f.name, f.reply)
+		return
+	}
+	c.record(m, started, "abandoned", DispositionAbandoned)
+}
@@ -0,0 +1,29 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestDisposition(t *testing.T) {
+	for _, v := range []struct {
+		name        string
+		disposition Disposition
+		deferred    bool
+		reason      string
+	}{
+		{"data.queued", DispositionAccepted, false, ""},
+		{"data.timeout", "deferred:data.timeout", true, "data.timeout"},
+		{"data.too-large", "rejected:data.too-large", false, "data.too-large"},
+	} {
+		d := newDisposition(v.name, replies[v.name])
+		if d != v.disposition {
+			t.Fatalf("%s != %s", d, v.disposition)
+		}
+		if d.Accepted() != (v.disposition == DispositionAccepted) || d.Deferred() != v.deferred {
+			t.Fatalf("%s classified incorrectly", d)
+		}
+		if r := d.Reason(); r != v.reason {
+			t.Fatalf("%q != %q", r, v.reason)
+		}
+	}
+}
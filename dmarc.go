@@ -0,0 +1,242 @@
+package smtpsrv
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// DMARCPolicy is a policy published in a DMARC record (RFC 7489), in order of
+// strictness.
+type DMARCPolicy int
+
+const (
+	// Take no action
+	DMARCPolicyNone DMARCPolicy = iota
+	// Treat the message as suspicious (deliver it to a spam folder, for
+	// example)
+	DMARCPolicyQuarantine
+	// Reject the message
+	DMARCPolicyReject
+)
+
+var dmarcPolicies = []string{"none", "quarantine", "reject"}
+
+// String returns the name of the policy as it appears in a DMARC record.
+func (p DMARCPolicy) String() string {
+	if int(p) < len(dmarcPolicies) {
+		return dmarcPolicies[p]
+	}
+	return strconv.Itoa(int(p))
+}
+
+// parseDMARCPolicy parses the value of the "p" or "sp" tag.
+func parseDMARCPolicy(v string) (DMARCPolicy, bool) {
+	for i, n := range dmarcPolicies {
+		if strings.EqualFold(v, n) {
+			return DMARCPolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+// DMARC is the result of evaluating the DMARC record of the domain in the
+// From header of a message.
+type DMARC struct {
+	// Domain in the From header
+	Domain string
+	// Result of the evaluation - "pass", "fail", "none" if the domain has no
+	// record, or "temperror" or "permerror" if it could not be looked up or
+	// parsed
+	Result string
+	// Whether a passing SPF or DKIM result was for a domain aligned with the
+	// From domain
+	SPFAligned  bool
+	DKIMAligned bool
+	// Policy published for the domain and the policy applied to the message,
+	// which is DMARCPolicyNone if it passed and may be less strict than the
+	// published policy if the record only applies it to a percentage of
+	// messages
+	Policy  DMARCPolicy
+	Applied DMARCPolicy
+}
+
+// dmarcRecord contains the tags of a DMARC record that affect evaluation.
+type dmarcRecord struct {
+	policy          DMARCPolicy
+	subdomainPolicy DMARCPolicy
+	strictSPF       bool
+	strictDKIM      bool
+	percent         int
+}
+
+// parseDMARCRecord parses a DMARC record (RFC 7489 section 6.3), returning
+// false if it is invalid.
+func parseDMARCRecord(record string) (*dmarcRecord, bool) {
+	var (
+		r = &dmarcRecord{percent: 100}
+		p bool
+		s bool
+	)
+	for i, tag := range strings.Split(record, ";") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) == 0 {
+			continue
+		}
+		j := strings.IndexByte(tag, '=')
+		if j == -1 {
+			return nil, false
+		}
+		name, value := strings.TrimSpace(tag[:j]), strings.TrimSpace(tag[j+1:])
+		switch {
+		case i == 0:
+			if name != "v" || value != "DMARC1" {
+				return nil, false
+			}
+		case name == "p":
+			if r.policy, p = parseDMARCPolicy(value); !p {
+				return nil, false
+			}
+		case name == "sp":
+			r.subdomainPolicy, s = parseDMARCPolicy(value)
+		case name == "adkim":
+			r.strictDKIM = value == "s"
+		case name == "aspf":
+			r.strictSPF = value == "s"
+		case name == "pct":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= 100 {
+				r.percent = n
+			}
+		}
+	}
+	if !p {
+		return nil, false
+	}
+	if !s {
+		r.subdomainPolicy = r.policy
+	}
+	return r, true
+}
+
+// aligned determines whether two domains are aligned, which for relaxed
+// alignment means that they share an organizational domain. Without a way to
+// find organizational domains, alignment is always strict.
+func aligned(a, b string, strict bool, org func(domain string) string) bool {
+	if strict || org == nil {
+		return strings.EqualFold(a, b)
+	}
+	return strings.EqualFold(org(strings.ToLower(a)), org(strings.ToLower(b)))
+}
+
+// lookupDMARCRecord finds the DMARC record for the domain, returning nil if
+// there is none.
+func lookupDMARCRecord(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, string) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return nil, "none"
+		}
+		return nil, "temperror"
+	}
+	var records []string
+	for _, t := range txts {
+		if strings.HasPrefix(t, "v=DMARC1") {
+			records = append(records, t)
+		}
+	}
+	if len(records) != 1 {
+		return nil, "none"
+	}
+	r, ok := parseDMARCRecord(records[0])
+	if !ok {
+		return nil, "permerror"
+	}
+	return r, ""
+}
+
+// fromDomain returns the domain of the single address in the From header of
+// the message or an empty string if there is not exactly one.
+func fromDomain(body string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	addrs, err := msg.Header.AddressList("From")
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	i := strings.LastIndexByte(addrs[0].Address, '@')
+	if i == -1 {
+		return ""
+	}
+	return strings.ToLower(addrs[0].Address[i+1:])
+}
+
+// CheckDMARC evaluates the DMARC record of the domain in the From header of
+// the message (RFC 7489), using its SPF result and the domains of any valid
+// DKIM signatures it carries. Nil is returned if the message does not have a
+// single From address. The org function returns the organizational domain of
+// a domain (such as "example.co.uk" for "mail.example.co.uk"), which requires
+// the Public Suffix List - if it is nil, the record of the organizational
+// domain is not consulted and alignment is always strict, since guessing
+// would let "attacker.co.uk" align with "victim.co.uk".
+func CheckDMARC(ctx context.Context, resolver Resolver, m *Message, dkimDomains []string, org func(domain string) string) *DMARC {
+	domain := fromDomain(m.Body)
+	if len(domain) == 0 {
+		return nil
+	}
+	d := &DMARC{Domain: domain}
+	r, result := lookupDMARCRecord(ctx, resolver, domain)
+	if result == "none" && org != nil {
+		if o := strings.ToLower(org(domain)); len(o) != 0 && o != domain {
+			r, result = lookupDMARCRecord(ctx, resolver, o)
+			if r != nil {
+				r.policy = r.subdomainPolicy
+			}
+		}
+	}
+	if r == nil {
+		d.Result = result
+		return d
+	}
+	d.Policy = r.policy
+	if m.SPF == SPFPass {
+		d.SPFAligned = aligned(spfDomain(m.From, m.Helo), domain, r.strictSPF, org)
+	}
+	for _, s := range dkimDomains {
+		if aligned(s, domain, r.strictDKIM, org) {
+			d.DKIMAligned = true
+			break
+		}
+	}
+	if d.SPFAligned || d.DKIMAligned {
+		d.Result = "pass"
+		return d
+	}
+	d.Result = "fail"
+	d.Applied = r.policy
+	// Messages that are not sampled are subject to the next less strict
+	// policy (RFC 7489 section 6.6.4)
+	if r.percent < 100 && rand.Intn(100) >= r.percent && d.Applied != DMARCPolicyNone {
+		d.Applied--
+	}
+	return d
+}
+
+// checkDMARC evaluates DMARC for the message if it is enabled and the client
+// has not authenticated.
+func (c *Client) checkDMARC(m *Message) *DMARC {
+	if !c.config.CheckDMARC || len(m.AuthUser) != 0 {
+		return nil
+	}
+	var domains []string
+	if c.config.VerifyDKIM != nil {
+		domains = c.config.VerifyDKIM(m)
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, spfTimeout)
+	defer cancel()
+	return CheckDMARC(ctx, c.resolver(), m, domains, c.config.OrganizationalDomain)
+}
@@ -0,0 +1,108 @@
+package smtpsrv
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// testOrganizationalDomain knows enough public suffixes for the tests.
+func testOrganizationalDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	n := 2
+	if strings.HasSuffix(domain, ".co.uk") {
+		n = 3
+	}
+	if len(labels) <= n {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func TestParseDMARCRecord(t *testing.T) {
+	r, ok := parseDMARCRecord("v=DMARC1; p=reject; sp=none; adkim=s; pct=50; rua=mailto:d@example.com")
+	if !ok {
+		t.Fatal("record should be valid")
+	}
+	if r.policy != DMARCPolicyReject || r.subdomainPolicy != DMARCPolicyNone ||
+		!r.strictDKIM || r.strictSPF || r.percent != 50 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	for _, v := range []string{
+		"v=DMARC1",
+		"p=reject; v=DMARC1",
+		"v=DMARC1; p=discard",
+	} {
+		if _, ok := parseDMARCRecord(v); ok {
+			t.Fatalf("%q should be invalid", v)
+		}
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	resolver := testResolver{
+		"txt:_dmarc.example.com":  {"v=DMARC1; p=reject; sp=quarantine"},
+		"txt:_dmarc.strict.com":   {"v=DMARC1; p=quarantine; aspf=s"},
+		"txt:_dmarc.broken.com":   {"v=DMARC1; p=maybe"},
+		"txt:_dmarc.victim.co.uk": {"v=DMARC1; p=reject"},
+	}
+	for _, v := range []struct {
+		from   string
+		sender string
+		spf    SPFResult
+		dkim   []string
+		result string
+		policy DMARCPolicy
+	}{
+		{"a@example.com", "a@example.com", SPFPass, nil, "pass", DMARCPolicyNone},
+		{"a@example.com", "a@mail.example.com", SPFPass, nil, "pass", DMARCPolicyNone},
+		{"a@example.com", "a@example.net", SPFPass, nil, "fail", DMARCPolicyReject},
+		{"a@example.com", "a@example.net", SPFPass, []string{"example.com"}, "pass", DMARCPolicyNone},
+		{"a@example.com", "a@example.com", SPFFail, nil, "fail", DMARCPolicyReject},
+		{"a@sub.example.com", "a@example.net", SPFNone, nil, "fail", DMARCPolicyQuarantine},
+		{"a@strict.com", "a@mail.strict.com", SPFPass, nil, "fail", DMARCPolicyQuarantine},
+		{"a@broken.com", "a@broken.com", SPFPass, nil, "permerror", DMARCPolicyNone},
+		{"a@example.org", "a@example.org", SPFPass, nil, "none", DMARCPolicyNone},
+		{"a@victim.co.uk", "a@attacker.co.uk", SPFPass, []string{"attacker.co.uk"}, "fail", DMARCPolicyReject},
+	} {
+		m := &Message{
+			From: v.sender,
+			Body: "From: <" + v.from + ">\r\n\r\ntest",
+			SPF:  v.spf,
+		}
+		d := CheckDMARC(context.Background(), resolver, m, v.dkim, testOrganizationalDomain)
+		if d.Result != v.result || d.Applied != v.policy {
+			t.Fatalf("%s %s: %s %s != %s %s", v.from, v.sender, d.Result, d.Applied, v.result, v.policy)
+		}
+	}
+	if d := CheckDMARC(context.Background(), resolver, &Message{Body: "\r\ntest"}, nil, nil); d != nil {
+		t.Fatal("nil expected without a From address")
+	}
+}
+
+func TestCheckDMARCStrict(t *testing.T) {
+	resolver := testResolver{
+		"txt:_dmarc.example.com":  {"v=DMARC1; p=reject; sp=none"},
+		"txt:_dmarc.victim.co.uk": {"v=DMARC1; p=reject"},
+	}
+	for _, v := range []struct {
+		from   string
+		sender string
+		result string
+	}{
+		{"a@example.com", "a@example.com", "pass"},
+		{"a@example.com", "a@mail.example.com", "fail"},
+		{"a@victim.co.uk", "a@attacker.co.uk", "fail"},
+		{"a@sub.example.com", "a@sub.example.com", "none"},
+	} {
+		m := &Message{
+			From: v.sender,
+			Body: "From: <" + v.from + ">\r\n\r\ntest",
+			SPF:  SPFPass,
+		}
+		d := CheckDMARC(context.Background(), resolver, m, nil, nil)
+		if d.Result != v.result {
+			t.Fatalf("%s %s: %s != %s", v.from, v.sender, d.Result, v.result)
+		}
+	}
+}
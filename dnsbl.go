@@ -0,0 +1,119 @@
+package smtpsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver performs the DNS lookups needed by the server. *net.Resolver
+// satisfies this interface and is used by default, but another
+// implementation can be supplied for testing or caching.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// BlocklistPolicy determines what happens when the client is listed by one of
+// the DNS blocklists.
+type BlocklistPolicy int
+
+const (
+	// Reject the client with 554
+	BlocklistReject BlocklistPolicy = iota
+	// Accept mail from the client and record the blocklists in
+	// Message.Blocklists so that the handler can treat it as suspect
+	BlocklistTag
+	// Only record the blocklists in the session and the journal
+	BlocklistLog
+)
+
+// blocklistTimeout is the maximum time spent querying the blocklists.
+const blocklistTimeout = 5 * time.Second
+
+// resolver returns the resolver used for DNS lookups.
+func (c *Client) resolver() Resolver {
+	if c.config.Resolver != nil {
+		return c.config.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// reverseIP returns the name under which the address is listed in a DNS
+// blocklist (RFC 5782 section 2.1), which for IPv4 addresses consists of the
+// octets in reverse order and for IPv6 addresses of the nibbles in reverse
+// order.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var (
+		ip16   = ip.To16()
+		labels = make([]string, 0, 32)
+	)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels,
+			fmt.Sprintf("%x", ip16[i]&0x0f),
+			fmt.Sprintf("%x", ip16[i]>>4),
+		)
+	}
+	return strings.Join(labels, ".")
+}
+
+// listed determines whether the addresses returned by a blocklist indicate
+// that the client is listed. Listings are in 127.0.0.0/8 (RFC 5782 section
+// 2.3), except for 127.255.255.0/24, which some blocklists use to report
+// errors such as exceeding their query limit.
+func listed(addrs []string) bool {
+	for _, a := range addrs {
+		ip := net.ParseIP(a).To4()
+		if ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupBlocklists queries each of the blocklists in parallel and returns
+// those that list the client, in the order in which they are configured.
+// Blocklists that cannot be queried are ignored.
+func (c *Client) lookupBlocklists() []string {
+	a, ok := c.session.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	var (
+		name        = reverseIP(a.IP)
+		results     = make([]bool, len(c.config.Blocklists))
+		ctx, cancel = context.WithTimeout(c.ctx, blocklistTimeout)
+		wg          sync.WaitGroup
+	)
+	defer cancel()
+	for i, zone := range c.config.Blocklists {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			addrs, err := c.resolver().LookupHost(ctx, name+"."+zone)
+			results[i] = err == nil && listed(addrs)
+		}(i, zone)
+	}
+	wg.Wait()
+	var zones []string
+	for i, r := range results {
+		if r {
+			zones = append(zones, c.config.Blocklists[i])
+		}
+	}
+	return zones
+}
+
+// checkBlocklists queries the blocklists and records those that list the
+// client in the session. False is returned if the client is to be rejected.
+func (c *Client) checkBlocklists() bool {
+	c.session.Blocklists = c.lookupBlocklists()
+	return len(c.session.Blocklists) == 0 || c.config.BlocklistPolicy != BlocklistReject
+}
@@ -0,0 +1,68 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// testResolver answers lookups from a map of names to addresses. TXT and MX
+// records are found by prefixing the name with "txt:" and "mx:".
+type testResolver map[string][]string
+
+func (r testResolver) lookup(name string) ([]string, error) {
+	if v, ok := r[name]; ok {
+		return v, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.lookup(host)
+}
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.lookup("txt:" + name)
+}
+
+func (r testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, err := r.lookup("mx:" + name)
+	if err != nil {
+		return nil, err
+	}
+	mxs := []*net.MX{}
+	for i, h := range hosts {
+		mxs = append(mxs, &net.MX{Host: h, Pref: uint16(10 * (i + 1))})
+	}
+	return mxs, nil
+}
+
+func TestReverseIP(t *testing.T) {
+	for _, v := range []struct {
+		ip   string
+		name string
+	}{
+		{"192.0.2.1", "1.2.0.192"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	} {
+		if n := reverseIP(net.ParseIP(v.ip)); n != v.name {
+			t.Fatalf("%q != %q", n, v.name)
+		}
+	}
+}
+
+func TestListed(t *testing.T) {
+	for _, v := range []struct {
+		addrs  []string
+		listed bool
+	}{
+		{nil, false},
+		{[]string{"127.0.0.2"}, true},
+		{[]string{"127.255.255.254"}, false},
+		{[]string{"192.0.2.1"}, false},
+	} {
+		if l := listed(v.addrs); l != v.listed {
+			t.Fatalf("%v: %v != %v", v.addrs, l, v.listed)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheTTL         = 5 * time.Minute
+	defaultCacheNegativeTTL = time.Minute
+	defaultCacheEntries     = 10000
+	// Time allowed for a lookup made in the background
+	cacheRefreshTimeout = 10 * time.Second
+)
+
+// cacheEntry is the result of a single lookup.
+type cacheEntry struct {
+	value      interface{}
+	err        error
+	expires    time.Time
+	hits       int
+	refreshing bool
+}
+
+// DNSCache is a Resolver that caches the results of another, so that the
+// server's DNS blocklist and SPF lookups (and those of any hooks that share
+// it) can be answered from memory. Since the standard library does not
+// expose the TTLs of records, each result is kept for a fixed time. Names
+// that do not exist are cached as well, but other errors are not. The zero
+// value is ready to use and it is safe for concurrent use.
+type DNSCache struct {
+	// Resolver used for lookups that cannot be answered from the cache - nil
+	// for net.DefaultResolver
+	Resolver Resolver
+	// How long results and names that do not exist are cached - 0 for five
+	// minutes and one minute respectively
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// How long an expired result may still be returned while it is looked up
+	// again in the background - 0 to look it up before returning
+	Stale time.Duration
+	// Number of times a result must be used before it expires to be looked up
+	// again in the background shortly beforehand, which keeps frequently used
+	// results (such as blocklist entries and the MX records of common sender
+	// domains) from ever expiring - 0 to disable
+	PrefetchHits int
+	// Maximum number of results cached - 0 for 10,000
+	MaxEntries int
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+	now     func() time.Time
+}
+
+// clock returns the current time.
+func (d *DNSCache) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// resolver returns the resolver used for lookups.
+func (d *DNSCache) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// ttl returns how long the result of a lookup is cached.
+func (d *DNSCache) ttl(err error) time.Duration {
+	if err != nil {
+		if d.NegativeTTL != 0 {
+			return d.NegativeTTL
+		}
+		return defaultCacheNegativeTTL
+	}
+	if d.TTL != 0 {
+		return d.TTL
+	}
+	return defaultCacheTTL
+}
+
+// cacheable determines whether the result of a lookup can be cached.
+func cacheable(err error) bool {
+	if err == nil {
+		return true
+	}
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
+
+// store caches the result of a lookup, making room for it if necessary. The
+// mutex must be held.
+func (d *DNSCache) store(key string, value interface{}, err error) {
+	if d.entries == nil {
+		d.entries = map[string]*cacheEntry{}
+	}
+	max := d.MaxEntries
+	if max == 0 {
+		max = defaultCacheEntries
+	}
+	if _, ok := d.entries[key]; !ok && len(d.entries) >= max {
+		now := d.clock()
+		for k, e := range d.entries {
+			if now.After(e.expires.Add(d.Stale)) {
+				delete(d.entries, k)
+			}
+		}
+		// Remove an arbitrary entry if none have expired
+		for k := range d.entries {
+			if len(d.entries) < max {
+				break
+			}
+			delete(d.entries, k)
+		}
+	}
+	d.entries[key] = &cacheEntry{
+		value:   value,
+		err:     err,
+		expires: d.clock().Add(d.ttl(err)),
+	}
+}
+
+// refresh looks up an entry again in the background, replacing it if the
+// lookup succeeds. The mutex must be held.
+func (d *DNSCache) refresh(key string, e *cacheEntry, fetch func(ctx context.Context) (interface{}, error)) {
+	e.refreshing = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshTimeout)
+		defer cancel()
+		v, err := fetch(ctx)
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if cacheable(err) {
+			d.store(key, v, err)
+		} else {
+			e.refreshing = false
+		}
+	}()
+}
+
+// lookup returns the cached result for the key, invoking fetch if there is
+// none.
+func (d *DNSCache) lookup(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	d.mutex.Lock()
+	if e, ok := d.entries[key]; ok {
+		now := d.clock()
+		switch {
+		case now.Before(e.expires):
+			e.hits++
+			if d.PrefetchHits != 0 && e.hits >= d.PrefetchHits && !e.refreshing &&
+				e.expires.Sub(now) < d.ttl(e.err)/10 {
+				d.refresh(key, e, fetch)
+			}
+			d.mutex.Unlock()
+			return e.value, e.err
+		case now.Before(e.expires.Add(d.Stale)):
+			if !e.refreshing {
+				d.refresh(key, e, fetch)
+			}
+			d.mutex.Unlock()
+			return e.value, e.err
+		}
+	}
+	d.mutex.Unlock()
+	v, err := fetch(ctx)
+	if cacheable(err) {
+		d.mutex.Lock()
+		d.store(key, v, err)
+		d.mutex.Unlock()
+	}
+	return v, err
+}
+
+// copyStrings returns a copy of the cached value so that callers may modify
+// it.
+func copyStrings(v interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), v.([]string)...), nil
+}
+
+// LookupHost returns the addresses of the host.
+func (d *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return copyStrings(d.lookup(ctx, "A "+host, func(ctx context.Context) (interface{}, error) {
+		return d.resolver().LookupHost(ctx, host)
+	}))
+}
+
+// LookupTXT returns the TXT records for the name.
+func (d *DNSCache) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return copyStrings(d.lookup(ctx, "TXT "+name, func(ctx context.Context) (interface{}, error) {
+		return d.resolver().LookupTXT(ctx, name)
+	}))
+}
+
+// LookupMX returns the MX records for the name, sorted by preference.
+func (d *DNSCache) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := d.lookup(ctx, "MX "+name, func(ctx context.Context) (interface{}, error) {
+		return d.resolver().LookupMX(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	mxs := []*net.MX{}
+	for _, mx := range v.([]*net.MX) {
+		c := *mx
+		mxs = append(mxs, &c)
+	}
+	return mxs, nil
+}
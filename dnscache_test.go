@@ -0,0 +1,141 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingResolver counts the lookups passed to a testResolver.
+type countingResolver struct {
+	mutex    sync.Mutex
+	resolver testResolver
+	count    int
+}
+
+func (r *countingResolver) lookups() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.count
+}
+
+func (r *countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count++
+	return r.resolver.LookupHost(ctx, host)
+}
+
+func (r *countingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count++
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+func (r *countingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count++
+	return r.resolver.LookupMX(ctx, name)
+}
+
+// waitForLookups waits for the resolver to have performed n lookups.
+func waitForLookups(t *testing.T, r *countingResolver, n int) {
+	for i := 0; r.lookups() != n; i++ {
+		if i == 100 {
+			t.Fatalf("%d != %d", r.lookups(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClock is a clock that is advanced manually.
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDNSCache(t *testing.T) {
+	var (
+		clock = &testClock{now: time.Now()}
+		r     = &countingResolver{resolver: testResolver{
+			"example.com":     {"192.0.2.1"},
+			"mx:example.com":  {"mail.example.com"},
+			"txt:example.com": {"v=spf1 -all"},
+		}}
+		d = &DNSCache{
+			Resolver: r,
+			Stale:    time.Minute,
+			now:      clock.Now,
+		}
+		ctx = context.Background()
+	)
+	for i := 0; i < 2; i++ {
+		if addrs, err := d.LookupHost(ctx, "example.com"); err != nil || addrs[0] != "192.0.2.1" {
+			t.Fatalf("unexpected result %v %v", addrs, err)
+		}
+		if mxs, err := d.LookupMX(ctx, "example.com"); err != nil || mxs[0].Host != "mail.example.com" {
+			t.Fatalf("unexpected result %v %v", mxs, err)
+		}
+		if txts, err := d.LookupTXT(ctx, "example.com"); err != nil || txts[0] != "v=spf1 -all" {
+			t.Fatalf("unexpected result %v %v", txts, err)
+		}
+		if _, err := d.LookupHost(ctx, "missing.example.com"); err == nil {
+			t.Fatal("error expected")
+		}
+	}
+	waitForLookups(t, r, 4)
+	// Once the negative result expires, the name is looked up again
+	clock.Add(2 * time.Minute)
+	d.LookupHost(ctx, "missing.example.com")
+	waitForLookups(t, r, 5)
+	// Expired results are returned while they are looked up again
+	r.mutex.Lock()
+	r.resolver["example.com"] = []string{"192.0.2.2"}
+	r.mutex.Unlock()
+	clock.Add(3*time.Minute + 30*time.Second)
+	if addrs, _ := d.LookupHost(ctx, "example.com"); addrs[0] != "192.0.2.1" {
+		t.Fatalf("%s != 192.0.2.1", addrs[0])
+	}
+	waitForLookups(t, r, 6)
+	if addrs, _ := d.LookupHost(ctx, "example.com"); addrs[0] != "192.0.2.2" {
+		t.Fatalf("%s != 192.0.2.2", addrs[0])
+	}
+}
+
+func TestDNSCachePrefetch(t *testing.T) {
+	var (
+		clock = &testClock{now: time.Now()}
+		r     = &countingResolver{resolver: testResolver{
+			"example.com": {"192.0.2.1"},
+		}}
+		d = &DNSCache{
+			Resolver:     r,
+			PrefetchHits: 2,
+			now:          clock.Now,
+		}
+		ctx = context.Background()
+	)
+	for i := 0; i < 3; i++ {
+		d.LookupHost(ctx, "example.com")
+	}
+	waitForLookups(t, r, 1)
+	clock.Add(4*time.Minute + 45*time.Second)
+	d.LookupHost(ctx, "example.com")
+	waitForLookups(t, r, 2)
+}
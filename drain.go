@@ -0,0 +1,34 @@
+package smtpsrv
+
+import (
+	"time"
+)
+
+// Ready determines whether the server is accepting new connections. It
+// returns false once Drain has been called, so it can be used to report the
+// health of the server to a load balancer.
+func (s *Server) Ready() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.draining
+}
+
+// Sessions returns the number of clients that are currently connected.
+func (s *Server) Sessions() int {
+	return s.registry.count()
+}
+
+// Drain prepares the server to be replaced, as in a rolling deploy. Ready
+// immediately begins returning false, giving load balancers the grace period
+// to stop sending new connections, after which the server stops accepting
+// them. Clients that are already connected are unaffected and the number of
+// them remaining is returned. Close must still be called to shut down the
+// server.
+func (s *Server) Drain(grace time.Duration) int {
+	s.mutex.Lock()
+	s.draining = true
+	s.mutex.Unlock()
+	time.Sleep(grace)
+	s.closeListeners()
+	return s.Sessions()
+}
@@ -0,0 +1,106 @@
+package smtpsrv
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidXtext = errors.New("invalid xtext")
+
+// dsnExtension advertises DSN (RFC 3461), which is always available.
+func (c *Client) dsnExtension() string {
+	return "DSN"
+}
+
+// decodeXtext decodes a value encoded as xtext (RFC 3461 section 4), where
+// "+" followed by two uppercase hexadecimal digits represents a byte.
+func decodeXtext(s string) (string, error) {
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+			return "", errInvalidXtext
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errInvalidXtext
+		}
+		b = append(b, byte(v))
+		i += 2
+	}
+	return string(b), nil
+}
+
+// checkNotifyParam ensures that NOTIFY is either NEVER or a list containing
+// one or more of SUCCESS, FAILURE, and DELAY.
+func (c *Client) checkNotifyParam(value string) bool {
+	values := strings.Split(strings.ToUpper(value), ",")
+	for _, v := range values {
+		switch v {
+		case "NEVER":
+			if len(values) == 1 {
+				continue
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+			continue
+		}
+		c.reply("param.invalid", "NOTIFY")
+		return false
+	}
+	return true
+}
+
+// checkORcptParam ensures that ORCPT consists of an address type followed by
+// ";" and an xtext-encoded address.
+func (c *Client) checkORcptParam(value string) bool {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) == 2 && isKeyword(parts[0]) {
+		if _, err := decodeXtext(parts[1]); err == nil {
+			return true
+		}
+	}
+	c.reply("param.invalid", "ORCPT")
+	return false
+}
+
+// checkRetParam ensures that RET is either FULL or HDRS.
+func (c *Client) checkRetParam(value string) bool {
+	switch strings.ToUpper(value) {
+	case "FULL", "HDRS":
+		return true
+	}
+	c.reply("param.invalid", "RET")
+	return false
+}
+
+// checkEnvIDParam ensures that ENVID is valid xtext of at most 100
+// characters.
+func (c *Client) checkEnvIDParam(value string) bool {
+	if _, err := decodeXtext(value); err != nil || len(value) > 100 {
+		c.reply("param.invalid", "ENVID")
+		return false
+	}
+	return true
+}
+
+// newRecipient creates a Recipient for the address from the parameters
+// supplied with RCPT, which are assumed to have been validated.
+func newRecipient(address string, params map[string]string) *Recipient {
+	r := &Recipient{
+		Address: address,
+		Params:  params,
+	}
+	if v, ok := params["NOTIFY"]; ok {
+		r.Notify = strings.Split(strings.ToUpper(v), ",")
+	}
+	if v, ok := params["ORCPT"]; ok {
+		parts := strings.SplitN(v, ";", 2)
+		r.ORcptType = parts[0]
+		r.ORcpt, _ = decodeXtext(parts[1])
+	}
+	return r
+}
@@ -0,0 +1,35 @@
+package smtpsrv
+
+// extensions lists the functions used to build the EHLO response. Each one
+// returns the keyword (and any parameters) for an extension or an empty string
+// if the extension is not available to the client. Since the set depends on
+// the state of the session (STARTTLS is withdrawn once TLS is active and AUTH
+// once the client has authenticated, for example), it is rebuilt each time
+// EHLO is issued. Extensions are advertised in the order they appear here.
+var extensions = []func(c *Client) string{
+	(*Client).starttlsExtension,
+	(*Client).authExtension,
+	(*Client).enhancedStatusCodesExtension,
+	(*Client).pipeliningExtension,
+	(*Client).sizeExtension,
+	(*Client).chunkingExtension,
+	(*Client).eightbitmimeExtension,
+	(*Client).binarymimeExtension,
+	(*Client).smtputf8Extension,
+	(*Client).dsnExtension,
+}
+
+// extensionLines returns the list of extensions available to the client. If
+// an Extensions hook is set, it is given the opportunity to modify the list.
+func (c *Client) extensionLines() []string {
+	lines := []string{}
+	for _, e := range extensions {
+		if l := e(c); len(l) != 0 {
+			lines = append(lines, l)
+		}
+	}
+	if c.config.Extensions != nil {
+		lines = c.config.Extensions(c, lines)
+	}
+	return lines
+}
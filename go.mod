@@ -0,0 +1,3 @@
+module github.com/hectane/go-smtpsrv
+
+go 1.21
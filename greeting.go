@@ -0,0 +1,26 @@
+package smtpsrv
+
+import (
+	"hash/fnv"
+	"net"
+)
+
+// greeting returns the banner used to greet the client. If variants are
+// configured, one is chosen for each connection in turn or, if
+// GreetingByAddress is set, by a hash of the client's IP address so that a
+// client always receives the same one.
+func (c *Client) greeting() string {
+	greetings := c.config.Greetings
+	if len(greetings) == 0 {
+		return c.config.Banner
+	}
+	i := c.sequence
+	if c.config.GreetingByAddress {
+		if a, ok := c.session.RemoteAddr.(*net.TCPAddr); ok {
+			h := fnv.New64a()
+			h.Write(a.IP.To16())
+			i = h.Sum64()
+		}
+	}
+	return greetings[i%uint64(len(greetings))]
+}
@@ -0,0 +1,36 @@
+package smtpsrv
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGreeting(t *testing.T) {
+	var (
+		config = &Config{
+			Banner:    "banner",
+			Greetings: []string{"a", "b", "c"},
+		}
+		addr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+		seen = map[string]bool{}
+	)
+	for i := uint64(0); i < 3; i++ {
+		c := &Client{config: config, session: &Session{RemoteAddr: addr}, sequence: i}
+		if g := c.greeting(); g != config.Greetings[i] {
+			t.Fatalf("%s != %s", g, config.Greetings[i])
+		}
+	}
+	config.GreetingByAddress = true
+	for i := uint64(0); i < 3; i++ {
+		c := &Client{config: config, session: &Session{RemoteAddr: addr}, sequence: i}
+		seen[c.greeting()] = true
+	}
+	if len(seen) != 1 {
+		t.Fatal("client should always receive the same greeting")
+	}
+	config.Greetings = nil
+	c := &Client{config: config, session: &Session{RemoteAddr: addr}}
+	if g := c.greeting(); g != "banner" {
+		t.Fatalf("unexpected greeting %s", g)
+	}
+}
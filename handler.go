@@ -0,0 +1,101 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errMessageTimeout   = errors.New("message was not received in time")
+	errKeepAliveAborted = errors.New("handler failed after keepalives were sent")
+)
+
+// Handler processes messages received by the server. ServeSMTP is invoked
+// once the client has finished sending the message and the client waits for
+// it to return. If it returns nil, the message is accepted. If it returns an
+// SMTPError, the client receives that reply; for other errors, the client is
+// told that the message could not be processed and may be retried.
+// The context is cancelled if the server is shut down or MessageTimeout
+// expires.
+type Handler interface {
+	ServeSMTP(ctx context.Context, m *Message) error
+}
+
+// HandlerFunc allows an ordinary function to be used as a Handler.
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+// ServeSMTP invokes f(ctx, m).
+func (f HandlerFunc) ServeSMTP(ctx context.Context, m *Message) error {
+	return f(ctx, m)
+}
+
+// messageContext returns the context passed to the handler, which expires
+// after the message timeout (if any).
+func (c *Client) messageContext() (context.Context, context.CancelFunc) {
+	if c.config.MessageTimeout != 0 {
+		return context.WithTimeout(c.ctx, c.config.MessageTimeout)
+	}
+	return context.WithCancel(c.ctx)
+}
+
+// serveMessage passes the message to the handler, which is run in a separate
+// goroutine so that keepalives (if enabled) can be sent while it runs and so
+// that the message timeout applies even if the handler ignores its context.
+// A handler that has not returned when the context expires is abandoned.
+func (c *Client) serveMessage(m *Message) error {
+	ctx, cancel := c.messageContext()
+	defer cancel()
+	var (
+		result = make(chan error, 1)
+		tick   <-chan time.Time
+		sent   bool
+	)
+	if c.config.KeepAlive != 0 && !c.config.LMTP {
+		ticker := time.NewTicker(c.config.KeepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	go func() {
+		if h, ok := c.config.Handler.(StreamHandler); ok {
+			result <- h.ServeSMTPStream(ctx, m, strings.NewReader(m.Body))
+		} else {
+			result <- c.config.Handler.ServeSMTP(ctx, m)
+		}
+	}()
+	for {
+		var err error
+		select {
+		case err = <-result:
+			if err == context.DeadlineExceeded {
+				err = errMessageTimeout
+			}
+		case <-ctx.Done():
+			err = errMessageTimeout
+		case <-tick:
+			c.sendContinuation(c.lookupReply("data.keepalive"))
+			c.flush()
+			sent = true
+			continue
+		}
+		if err != nil && sent {
+			return errKeepAliveAborted
+		}
+		return err
+	}
+}
+
+// sendContinuation sends the reply as the beginning of a multi-line reply.
+// Since the final line of a multi-line reply must have the same code (RFC
+// 5321 section 4.2.1), only replies indicating success may be sent this way.
+func (c *Client) sendContinuation(r Reply) {
+	prefix := strconv.Itoa(r.Code) + "-"
+	if len(r.Enhanced) != 0 {
+		prefix += r.Enhanced + " "
+	}
+	for _, l := range strings.Split(r.Message, "\n") {
+		c.writer.WriteString(prefix + l + "\r\n")
+	}
+}
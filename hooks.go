@@ -0,0 +1,20 @@
+package smtpsrv
+
+// errorReply returns the reply for an error returned by a hook or handler.
+// An SMTPError is used as-is, while the named reply is used for other errors.
+func (c *Client) errorReply(name string, err error) Reply {
+	switch e := err.(type) {
+	case SMTPError:
+		return e.Reply()
+	case *SMTPError:
+		return e.Reply()
+	case *DecodeError:
+		return c.lookupReply("data.decode-limit", e.Limit)
+	}
+	return c.lookupReply(name)
+}
+
+// rejected sends the reply for an error returned by a hook.
+func (c *Client) rejected(name string, err error) {
+	c.sendReply(c.errorReply(name, err))
+}
@@ -0,0 +1,187 @@
+package smtpsrv
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Hop describes a server that relayed a message, as recorded in one of its
+// Received headers (RFC 5321 section 4.4). Fields that were not present in
+// the header are empty.
+type Hop struct {
+	// Hostname supplied by the client with HELO or EHLO
+	From string
+	// Hostname and IP address of the client as recorded by the server, such
+	// as the result of a reverse DNS lookup
+	Host string
+	IP   net.IP
+	// Hostname of the server that received the message
+	By string
+	// Protocol used (such as "ESMTPS") in uppercase
+	With string
+	// Identifier assigned to the message by the server
+	ID string
+	// Recipient of the message, without angle brackets
+	For string
+	// Time at which the server received the message
+	Time time.Time
+	// Time that elapsed between the previous hop and this one - zero if
+	// either time is unknown
+	Delay time.Duration
+}
+
+// readComment splits a string beginning with a comment into the content of
+// the comment (which may contain nested comments) and the rest of the string.
+func readComment(v string) (string, string) {
+	depth := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return v[1:i], v[i+1:]
+			}
+		}
+	}
+	return v[1:], ""
+}
+
+// parseHopAddress extracts the IP address (and hostname, if any) from the
+// comment following the "from" clause, which typically takes the form
+// "(host.example.com [192.0.2.1])".
+func (h *Hop) parseHopAddress(comment string) {
+	for _, f := range strings.Fields(comment) {
+		if ip := parseHopIP(f); ip != nil {
+			if h.IP == nil {
+				h.IP = ip
+			}
+			continue
+		}
+		if len(h.Host) == 0 && strings.Contains(f, ".") && !strings.Contains(f, "=") {
+			h.Host = strings.ToLower(f)
+		}
+	}
+}
+
+// parseHopIP parses an IP address that may be enclosed in brackets and
+// prefixed with "IPv6:".
+func parseHopIP(v string) net.IP {
+	v = strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+	if len(v) > 5 && strings.EqualFold(v[:5], "IPv6:") {
+		v = v[5:]
+	}
+	return net.ParseIP(v)
+}
+
+// parseReceived parses the value of a Received header. Clauses that are not
+// recognized are ignored.
+func parseReceived(v string) *Hop {
+	var (
+		h      = &Hop{}
+		expect string
+		last   string
+	)
+	if i := strings.LastIndexByte(v, ';'); i != -1 {
+		if t, err := mail.ParseDate(strings.TrimSpace(v[i+1:])); err == nil {
+			h.Time = t
+		}
+		v = v[:i]
+	}
+	for {
+		v = strings.TrimLeft(v, " \t\r\n")
+		if len(v) == 0 {
+			break
+		}
+		if v[0] == '(' {
+			var comment string
+			comment, v = readComment(v)
+			// Only the first comment following the "from" clause records
+			// the address of the client
+			if last == "from" {
+				h.parseHopAddress(comment)
+				last = ""
+			}
+			continue
+		}
+		i := strings.IndexAny(v, " \t\r\n(")
+		if i == -1 {
+			i = len(v)
+		}
+		tok := v[:i]
+		v = v[i:]
+		if len(expect) == 0 {
+			switch k := strings.ToLower(tok); k {
+			case "from", "by", "via", "with", "id", "for":
+				expect = k
+			}
+			continue
+		}
+		switch expect {
+		case "from":
+			if ip := parseHopIP(tok); ip != nil && strings.HasPrefix(tok, "[") {
+				h.IP = ip
+			} else {
+				h.From = strings.ToLower(tok)
+			}
+		case "by":
+			h.By = strings.ToLower(tok)
+		case "with":
+			h.With = strings.ToUpper(tok)
+		case "id":
+			h.ID = tok
+		case "for":
+			h.For = strings.TrimSuffix(strings.TrimPrefix(tok, "<"), ">")
+		}
+		last = expect
+		expect = ""
+	}
+	return h
+}
+
+// parseReceivedChain parses each of the Received headers, which are in order
+// from the most recent hop to the earliest, and computes the delay at each
+// hop.
+func parseReceivedChain(h mail.Header) []*Hop {
+	var hops []*Hop
+	for _, v := range h["Received"] {
+		hops = append(hops, parseReceived(v))
+	}
+	for i := 0; i < len(hops)-1; i++ {
+		if !hops[i].Time.IsZero() && !hops[i+1].Time.IsZero() {
+			hops[i].Delay = hops[i].Time.Sub(hops[i+1].Time)
+		}
+	}
+	return hops
+}
+
+// Origin returns the earliest hop that recorded the IP address of its client,
+// which identifies where the message was first submitted, or nil if there is
+// none. Since any of the headers may have been forged by the sender, only
+// hops added by trusted servers are reliable.
+func (p *ParsedMessage) Origin() *Hop {
+	for i := len(p.Received) - 1; i >= 0; i-- {
+		if p.Received[i].IP != nil {
+			return p.Received[i]
+		}
+	}
+	return nil
+}
+
+// Loops returns the number of hops in which the message was received by the
+// named host, so that messages caught in a mail loop can be rejected once
+// they have passed through the same server too many times.
+func (p *ParsedMessage) Loops(host string) int {
+	n := 0
+	for _, h := range p.Received {
+		if strings.EqualFold(h.By, host) {
+			n++
+		}
+	}
+	return n
+}
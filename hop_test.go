@@ -0,0 +1,96 @@
+package smtpsrv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseReceived(t *testing.T) {
+	for _, v := range []struct {
+		header string
+		hop    Hop
+	}{
+		{
+			"from client.example.com ([192.0.2.1])\r\n" +
+				"\tby mx.example.com (go-smtpsrv) with ESMTPS id 0123abcd\r\n" +
+				"\t(version=TLS 1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n" +
+				"\tfor <user@example.com>;\r\n" +
+				"\tMon, 02 Jan 2006 15:04:05 -0700",
+			Hop{
+				From: "client.example.com",
+				IP:   net.ParseIP("192.0.2.1"),
+				By:   "mx.example.com",
+				With: "ESMTPS",
+				ID:   "0123abcd",
+				For:  "user@example.com",
+				Time: time.Date(2006, 1, 2, 22, 4, 5, 0, time.UTC),
+			},
+		},
+		{
+			"from Client.example.com (unknown [IPv6:2001:db8::1]) " +
+				"(using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits)) " +
+				"by mx.example.com (Postfix) with esmtp id 4F1A2B3C; " +
+				"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
+			Hop{
+				From: "client.example.com",
+				IP:   net.ParseIP("2001:db8::1"),
+				By:   "mx.example.com",
+				With: "ESMTP",
+				ID:   "4F1A2B3C",
+				Time: time.Date(2006, 1, 2, 22, 4, 5, 0, time.UTC),
+			},
+		},
+		{
+			"from relay (relay.example.com [198.51.100.2]) by mx.example.com",
+			Hop{
+				From: "relay",
+				Host: "relay.example.com",
+				IP:   net.ParseIP("198.51.100.2"),
+				By:   "mx.example.com",
+			},
+		},
+		{
+			"by localhost with LMTP; invalid",
+			Hop{
+				By:   "localhost",
+				With: "LMTP",
+			},
+		},
+	} {
+		h := parseReceived(v.header)
+		if h.From != v.hop.From || h.Host != v.hop.Host || !h.IP.Equal(v.hop.IP) ||
+			h.By != v.hop.By || h.With != v.hop.With || h.ID != v.hop.ID ||
+			h.For != v.hop.For || !h.Time.Equal(v.hop.Time) {
+			t.Fatalf("%+v != %+v", h, v.hop)
+		}
+	}
+}
+
+func TestReceivedChain(t *testing.T) {
+	m := &Message{
+		Body: "Received: from b.example.com ([198.51.100.2]) by mx.example.com;\r\n" +
+			" Mon, 2 Jan 2006 15:04:35 +0000\r\n" +
+			"Received: from a.example.com ([192.0.2.1]) by b.example.com;\r\n" +
+			" Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+			"Received: by a.example.com; Mon, 2 Jan 2006 15:04:00 +0000\r\n" +
+			"\r\n" +
+			"test",
+	}
+	p, err := m.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Received) != 3 {
+		t.Fatalf("%d != 3", len(p.Received))
+	}
+	if d := p.Received[0].Delay; d != 30*time.Second {
+		t.Fatalf("%s != %s", d, 30*time.Second)
+	}
+	if o := p.Origin(); o != p.Received[1] {
+		t.Fatalf("%+v != %+v", o, p.Received[1])
+	}
+	if n := p.Loops("A.example.com"); n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+}
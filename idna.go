@@ -0,0 +1,142 @@
+package smtpsrv
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parameters for Punycode as defined in RFC 3492 section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycodeOverflow = errors.New("punycode overflow")
+
+// isASCII determines whether s consists entirely of ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punyAdapt is the bias adaptation function from RFC 3492 section 6.1.
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyDigit returns the character used to represent the digit d.
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punycode encodes s using the algorithm in RFC 3492 section 6.3.
+func punycode(s string) (string, error) {
+	var (
+		runes = []rune(s)
+		out   = []byte{}
+	)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	if b > 0 {
+		out = append(out, '-')
+	}
+	var (
+		n     = punyInitialN
+		delta = 0
+		bias  = punyInitialBias
+	)
+	for h := b; h < len(runes); {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (1<<31-1-delta)/(h+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// ASCIIAddress converts the domain of an internationalized address to its
+// ASCII form by encoding each non-ASCII label with Punycode and adding the
+// "xn--" prefix. Labels are lowercased first but the full IDNA mapping (RFC
+// 5895) is not performed. The local part cannot be converted and is returned
+// unchanged.
+func ASCIIAddress(address string) (string, error) {
+	i := strings.LastIndex(address, "@")
+	if i == -1 || isASCII(address[i+1:]) {
+		return address, nil
+	}
+	labels := strings.Split(strings.ToLower(address[i+1:]), ".")
+	for j, l := range labels {
+		if isASCII(l) {
+			continue
+		}
+		p, err := punycode(l)
+		if err != nil {
+			return "", err
+		}
+		labels[j] = "xn--" + p
+	}
+	return address[:i+1] + strings.Join(labels, "."), nil
+}
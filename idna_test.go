@@ -0,0 +1,25 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestASCIIAddress(t *testing.T) {
+	for _, v := range []struct {
+		address string
+		ascii   string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"user@Bücher.example", "user@xn--bcher-kva.example"},
+		{"用户@例子.测试", "用户@xn--fsqu00a.xn--0zwm56d"},
+		{"jürgen@münchen.de", "jürgen@xn--mnchen-3ya.de"},
+	} {
+		a, err := ASCIIAddress(v.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != v.ascii {
+			t.Fatalf("%s != %s", a, v.ascii)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package smtpsrv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// journalEntry is the record written to the journal for each completed
+// transaction. The result is "queued" if the message was accepted, "timeout"
+// if it was discarded because it was not received in time, "failed" if the
+// handler returned an error, "rejected" if the sender, every recipient, its
+// content, or the DMARC policy of its From domain was refused, "abandoned"
+// if the client ended the transaction before sending a message, and
+// "unacknowledged" if the message was accepted but the reply could not be
+// sent to the client, which is likely to send it again. The disposition
+// records the same outcome in terms of the reply that was sent.
+type journalEntry struct {
+	Time        time.Time `json:"time"`
+	QueueID     string    `json:"queue_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Helo        string    `json:"helo"`
+	TLS         bool      `json:"tls"`
+	AuthUser    string    `json:"auth_user,omitempty"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+	Duration    float64   `json:"duration"`
+	Result      string    `json:"result"`
+	Disposition string    `json:"disposition"`
+	Quirks      []string  `json:"quirks,omitempty"`
+	Blocklists  []string  `json:"blocklists,omitempty"`
+	SPF         string    `json:"spf,omitempty"`
+	DMARC       string    `json:"dmarc,omitempty"`
+}
+
+// journal records a completed transaction if a journal is configured. The
+// duration is measured from MAIL to the end of the transaction. Each entry is
+// written with a single call to Write and errors are ignored so that a
+// failing journal does not prevent mail from being received.
+func (c *Client) journal(m *Message, started time.Time, result string, d Disposition) {
+	if c.config.Journal == nil {
+		return
+	}
+	var dmarc string
+	if m.DMARC != nil {
+		dmarc = m.DMARC.Result
+	}
+	now := time.Now()
+	b, err := json.Marshal(&journalEntry{
+		Time:        now.UTC(),
+		QueueID:     m.QueueID,
+		RemoteAddr:  c.RemoteAddr().String(),
+		Helo:        m.Helo,
+		TLS:         c.IsTLS(),
+		AuthUser:    m.AuthUser,
+		From:        m.From,
+		To:          m.To,
+		Size:        m.Size,
+		Checksum:    hex.EncodeToString(m.Checksum[:]),
+		Duration:    now.Sub(started).Seconds(),
+		Result:      result,
+		Disposition: string(d),
+		Quirks:      c.session.Quirks.Names(),
+		Blocklists:  c.session.Blocklists,
+		SPF:         string(m.SPF),
+		DMARC:       dmarc,
+	})
+	if err != nil {
+		return
+	}
+	c.config.Journal.Write(append(b, '\n'))
+}
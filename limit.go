@@ -0,0 +1,74 @@
+package smtpsrv
+
+import (
+	"net"
+	"sync"
+)
+
+// connections counts the clients connected from each IP address so that
+// MaxConnectionsPerIP can be enforced.
+type connections struct {
+	mutex sync.Mutex
+	count map[string]int
+}
+
+// acquire counts a connection from the address unless max connections from
+// it are already counted, in which case false is returned.
+func (n *connections) acquire(ip string, max int) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.count == nil {
+		n.count = map[string]int{}
+	}
+	if n.count[ip] >= max {
+		return false
+	}
+	n.count[ip]++
+	return true
+}
+
+// release stops counting a connection from the address.
+func (n *connections) release(ip string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.count[ip]--; n.count[ip] <= 0 {
+		delete(n.count, ip)
+	}
+}
+
+// connectionIP returns the address counted towards MaxConnectionsPerIP or
+// an empty string if the client's connection is not limited.
+func (c *Client) connectionIP() string {
+	if c.config.MaxConnectionsPerIP == 0 || c.connections == nil {
+		return ""
+	}
+	if a, ok := c.session.RemoteAddr.(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return ""
+}
+
+// acquireConnection enforces the connection limits. If either of them has
+// been reached, the client is sent 421 and false is returned, in which case
+// the client should be disconnected.
+func (c *Client) acquireConnection() bool {
+	if c.tooMany {
+		c.reply("connect.too-many")
+		c.flush()
+		return false
+	}
+	if ip := c.connectionIP(); len(ip) != 0 &&
+		!c.connections.acquire(ip, c.config.MaxConnectionsPerIP) {
+		c.reply("connect.too-many-ip")
+		c.flush()
+		return false
+	}
+	return true
+}
+
+// releaseConnection stops counting the client towards MaxConnectionsPerIP.
+func (c *Client) releaseConnection() {
+	if ip := c.connectionIP(); len(ip) != 0 {
+		c.connections.release(ip)
+	}
+}
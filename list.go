@@ -0,0 +1,93 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// ListHeaders contains the headers added to messages sent by mailing lists
+// (RFC 2369 and RFC 2919). Each of the URI lists is in order of preference.
+type ListHeaders struct {
+	// Identifier from List-Id (such as "list.example.com") and the optional
+	// description preceding it
+	ID          string
+	Description string
+	Help        []string
+	Unsubscribe []string
+	Subscribe   []string
+	// URIs for posting to the list - empty if posting is not allowed
+	Post    []string
+	Owner   []string
+	Archive []string
+	// The sender supports one-click unsubscription (RFC 8058) by sending a
+	// POST request to the HTTPS URI in Unsubscribe
+	OneClick bool
+}
+
+// parseListURIs extracts the URIs enclosed in angle brackets from a List-*
+// header. Comments and anything outside the brackets are ignored.
+func parseListURIs(v string) []string {
+	var uris []string
+	for {
+		i := strings.IndexByte(v, '<')
+		if i == -1 {
+			break
+		}
+		j := strings.IndexByte(v[i:], '>')
+		if j == -1 {
+			break
+		}
+		uri := strings.Join(strings.Fields(v[i+1:i+j]), "")
+		if len(uri) != 0 {
+			uris = append(uris, uri)
+		}
+		v = v[i+j+1:]
+	}
+	return uris
+}
+
+// parseListHeaders extracts the mailing list headers from a message or
+// returns nil if there are none.
+func parseListHeaders(h mail.Header) *ListHeaders {
+	var (
+		l     = &ListHeaders{}
+		found bool
+	)
+	for _, f := range []struct {
+		name string
+		uris *[]string
+	}{
+		{"List-Help", &l.Help},
+		{"List-Unsubscribe", &l.Unsubscribe},
+		{"List-Subscribe", &l.Subscribe},
+		{"List-Post", &l.Post},
+		{"List-Owner", &l.Owner},
+		{"List-Archive", &l.Archive},
+	} {
+		if v := h.Get(f.name); len(v) != 0 {
+			*f.uris = parseListURIs(v)
+			found = true
+		}
+	}
+	if v := h.Get("List-Id"); len(v) != 0 {
+		if uris := parseListURIs(v); len(uris) != 0 {
+			l.ID = uris[0]
+			l.Description = strings.Trim(strings.TrimSpace(v[:strings.IndexByte(v, '<')]), "\"")
+		} else {
+			l.ID = strings.TrimSpace(v)
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	if strings.TrimSpace(h.Get("List-Unsubscribe-Post")) == "List-Unsubscribe=One-Click" {
+		for _, u := range l.Unsubscribe {
+			if strings.HasPrefix(strings.ToLower(u), "https:") {
+				l.OneClick = true
+				break
+			}
+		}
+	}
+	return l
+}
@@ -0,0 +1,45 @@
+package smtpsrv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseListHeaders(t *testing.T) {
+	m := &Message{
+		Body: "List-Id: \"Example list\" <list.example.com>\r\n" +
+			"List-Unsubscribe: <mailto:leave@example.com>,\r\n" +
+			"    <https://example.com/unsubscribe?id=1>\r\n" +
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n" +
+			"List-Post: NO (posting not allowed)\r\n" +
+			"Subject: test\r\n" +
+			"\r\n" +
+			content,
+	}
+	p, err := m.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Body != content {
+		t.Fatalf("%q != %q", p.Body, content)
+	}
+	l := &ListHeaders{
+		ID:          "list.example.com",
+		Description: "Example list",
+		Unsubscribe: []string{
+			"mailto:leave@example.com",
+			"https://example.com/unsubscribe?id=1",
+		},
+		OneClick: true,
+	}
+	if !reflect.DeepEqual(p.List, l) {
+		t.Fatalf("%+v != %+v", p.List, l)
+	}
+	m.Body = "Subject: test\r\n\r\n" + content
+	if p, err = m.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if p.List != nil {
+		t.Fatal("list headers should not have been found")
+	}
+}
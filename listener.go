@@ -0,0 +1,96 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+)
+
+// Listener describes an additional address on which NewServer accepts
+// connections, such as port 465 for implicit TLS or port 587 for submission.
+// Messages received on every listener are delivered to the same channel or
+// Handler and all of them are closed when the server is shut down.
+type Listener struct {
+	// Name of the listener (such as "submission"), recorded in the session
+	// of each client that connects to it
+	Name string
+	// Address to listen on for new connections
+	Addr string
+	// Expect clients to negotiate TLS as soon as they connect (RFC 8314)
+	// instead of using STARTTLS - TLSConfig must be set
+	ImplicitTLS bool
+	// Configuration used for clients that connect to the listener in place
+	// of the server's (other than Addr and Listeners) - nil to use the
+	// server's
+	Config *Config
+}
+
+// listenerConfig returns the configuration used for clients that connect to
+// the listener.
+func (s *Server) listenerConfig(li *Listener) *Config {
+	if li != nil && li.Config != nil {
+		return li.Config
+	}
+	return s.config
+}
+
+// listen creates the network listener for the listener, wrapping it for TLS
+// if necessary.
+func (s *Server) listen(li *Listener) (net.Listener, error) {
+	if li.ImplicitTLS && s.listenerConfig(li).TLSConfig == nil {
+		return nil, errNoTLSConfig
+	}
+	l, err := net.Listen("tcp", li.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(l, li)
+}
+
+// wrap wraps the network listener for TLS if the listener uses implicit TLS.
+func (s *Server) wrap(l net.Listener, li *Listener) (net.Listener, error) {
+	if !li.ImplicitTLS {
+		return l, nil
+	}
+	config := s.listenerConfig(li)
+	if config.TLSConfig == nil {
+		return nil, errNoTLSConfig
+	}
+	return &tlsListener{Listener: l, config: config.TLSConfig}, nil
+}
+
+// tlsListener accepts connections that use implicit TLS. Unlike the listener
+// returned by tls.NewListener, TLS is left to the client so that a PROXY
+// protocol header preceding the handshake can be read first.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+// Accept waits for the next connection.
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &pendingTLSConn{Conn: conn, config: l.config}, nil
+}
+
+// pendingTLSConn is a connection accepted by a tlsListener on which TLS has
+// not yet begun.
+type pendingTLSConn struct {
+	net.Conn
+	config *tls.Config
+}
+
+// bufferedConn is a connection whose initial data has already been read into
+// a buffer, which is drained before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer.
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,38 @@
+package smtpsrv
+
+// isSMTP determines whether the server is speaking SMTP.
+func isSMTP(config *Config) bool {
+	return !config.LMTP
+}
+
+// isLMTP determines whether the server is speaking LMTP (RFC 2033).
+func isLMTP(config *Config) bool {
+	return config.LMTP
+}
+
+// processLHLO responds to LHLO, which replaces HELO and EHLO in LMTP but is
+// otherwise identical to EHLO.
+func (c *Client) processLHLO(b []byte) {
+	c.processEHLO(b)
+}
+
+// helloCommand returns the command clients use to identify themselves.
+func (c *Client) helloCommand() string {
+	if c.config.LMTP {
+		return "LHLO"
+	}
+	return "EHLO"
+}
+
+// replyData sends the reply to the end of the message data. In LMTP, one
+// reply is sent for each of the n recipients of the message (RFC 2033 section
+// 4.2); they all receive the same reply since delivery is left to the
+// application.
+func (c *Client) replyData(n int, r Reply) {
+	if !c.config.LMTP {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		c.sendReply(r)
+	}
+}
@@ -1,8 +1,192 @@
 package smtpsrv
 
-// Message represents a raw message received from a client.
+import (
+	"crypto/sha256"
+	"net"
+	"time"
+)
+
+// Recipient describes a single recipient of a message along with the ESMTP
+// parameters that were supplied with it.
+type Recipient struct {
+	Address string
+	// Conditions under which a delivery status notification was requested
+	// (RFC 3461) - either NEVER or any of SUCCESS, FAILURE, and DELAY
+	Notify []string
+	// Type (usually "rfc822") and decoded value of the original recipient
+	ORcptType string
+	ORcpt     string
+	// ESMTP parameters supplied with RCPT, with keywords in uppercase
+	Params map[string]string
+	// The recipient trusts the sender according to Config.Allowlist
+	Allowlisted bool
+}
+
+// Message represents a raw message received from a client. Once a message
+// has been delivered, the server keeps no references to it or to any of the
+// values it contains, so it may be retained and modified freely.
 type Message struct {
+	// Sender of the message - empty for the null reverse-path ("<>") used by
+	// bounces and other notifications
 	From string
 	To   []string
+	// Recipients in the same order as To, along with their parameters
+	Recipients []*Recipient
+	// Content of the message - for messages sent with DATA, the CRLF ending
+	// the last line is omitted
 	Body string
+	// Content of the message exactly as it was transferred, after removing
+	// dot-stuffing - headers added by the server are not included
+	Raw []byte
+	// ESMTP parameters supplied with MAIL, with keywords in uppercase - this
+	// includes RET and ENVID if a delivery status notification was requested
+	Params map[string]string
+	// Hostname supplied by the client with HELO or EHLO
+	Helo string
+	// IP address supplied with HELO or EHLO as an address literal (such as
+	// "[192.0.2.1]") or nil if a hostname was used
+	HeloAddr net.IP
+	// Username supplied with AUTH or empty if the client did not authenticate
+	AuthUser string
+	// Address of the client that sent the message
+	RemoteAddr net.Addr
+	// Address of the client that originally submitted the message, found by
+	// following the Received headers added by Config.TrustedRelays - nil if
+	// TrustedRelays is not set or the message was passed to a StreamHandler
+	OriginIP net.IP
+	// DNS blocklists that list the client if Config.BlocklistPolicy is
+	// BlocklistTag
+	Blocklists []string
+	// Result of the SPF check performed for the sender if Config.CheckSPF is
+	// set - empty if it is not set or the client authenticated
+	SPF SPFResult
+	// Result of evaluating the DMARC record of the domain in the From header
+	// if Config.CheckDMARC is set - nil if it is not set, the client
+	// authenticated, the message was passed to a StreamHandler, or it does
+	// not have a single From address
+	DMARC *DMARC
+	// Time at which the message was received in its entirety
+	ReceivedAt time.Time
+	// Unique identifier assigned to the message by Config.QueueIDs, which is
+	// included in the reply sent to the client, its Received header, and the
+	// journal
+	QueueID string
+	// TLS version and cipher suite (see the constants in crypto/tls) used
+	// when the message was received - zero if TLS was not used
+	TLSVersion     uint16
+	TLSCipherSuite uint16
+	// Number of bytes received from the client and their SHA-256 digest,
+	// computed as they arrived - headers added by the server are not included
+	// and headers it strips are
+	Size     int64
+	Checksum [sha256.Size]byte
+	// Outcome of the transaction, which is only known once the reply to the
+	// message has been sent - set on the message passed to Config.OnFinish
+	// and empty on the message passed to the handler
+	Disposition Disposition
+	// Limits applied by Parse to the decoded content, from
+	// Config.DecodeLimits - nil to only limit the nesting depth
+	DecodeLimits *DecodeLimits
+	// Session in which the message was received, as it was when the message
+	// was sent
+	Session *Session
+}
+
+// copyParams returns a copy of a set of ESMTP parameters.
+func copyParams(params map[string]string) map[string]string {
+	if params == nil {
+		return nil
+	}
+	c := make(map[string]string, len(params))
+	for k, v := range params {
+		c[k] = v
+	}
+	return c
+}
+
+// clone returns a deep copy of the recipient.
+func (r *Recipient) clone() *Recipient {
+	c := *r
+	if r.Notify != nil {
+		c.Notify = append([]string(nil), r.Notify...)
+	}
+	c.Params = copyParams(r.Params)
+	return &c
+}
+
+// Clone returns a deep copy of the message. The TLS connection state in the
+// session is copied but the certificates it refers to are shared, since they
+// are not expected to be modified.
+func (m *Message) Clone() *Message {
+	c := *m
+	if m.To != nil {
+		c.To = append([]string(nil), m.To...)
+	}
+	if m.Recipients != nil {
+		c.Recipients = make([]*Recipient, len(m.Recipients))
+		for i, r := range m.Recipients {
+			c.Recipients[i] = r.clone()
+		}
+	}
+	c.Params = copyParams(m.Params)
+	if m.Raw != nil {
+		c.Raw = append([]byte(nil), m.Raw...)
+	}
+	if m.HeloAddr != nil {
+		c.HeloAddr = append(net.IP(nil), m.HeloAddr...)
+	}
+	if m.OriginIP != nil {
+		c.OriginIP = append(net.IP(nil), m.OriginIP...)
+	}
+	if m.Blocklists != nil {
+		c.Blocklists = append([]string(nil), m.Blocklists...)
+	}
+	if m.DMARC != nil {
+		d := *m.DMARC
+		c.DMARC = &d
+	}
+	if m.Session != nil {
+		s := *m.Session
+		if s.Blocklists != nil {
+			s.Blocklists = append([]string(nil), s.Blocklists...)
+		}
+		if s.TLS != nil {
+			state := *s.TLS
+			s.TLS = &state
+		}
+		if s.Values != nil {
+			s.Values = make(map[interface{}]interface{}, len(m.Session.Values))
+			for k, v := range m.Session.Values {
+				s.Values[k] = v
+			}
+		}
+		c.Session = &s
+	}
+	return &c
+}
+
+// Split divides the message into one message for each distinct value
+// returned by key for its recipients (such as the domain of each address) so
+// that they can be delivered separately. Each message is a clone of the
+// original with only its own recipients. The messages are in the order in
+// which their first recipient appears.
+func (m *Message) Split(key func(r *Recipient) string) []*Message {
+	var (
+		messages = []*Message{}
+		index    = map[string]*Message{}
+	)
+	for _, r := range m.Recipients {
+		k := key(r)
+		s, ok := index[k]
+		if !ok {
+			s = m.Clone()
+			s.To = []string{}
+			s.Recipients = []*Recipient{}
+			index[k] = s
+			messages = append(messages, s)
+		}
+		s.To = append(s.To, r.Address)
+		s.Recipients = append(s.Recipients, r.clone())
+	}
+	return messages
 }
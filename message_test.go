@@ -0,0 +1,66 @@
+package smtpsrv
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageClone(t *testing.T) {
+	m := &Message{
+		From:       testEmail1,
+		To:         []string{testEmail2},
+		Recipients: []*Recipient{{Address: testEmail2, Params: map[string]string{"NOTIFY": "NEVER"}}},
+		Params:     map[string]string{"BODY": "8BITMIME"},
+		Raw:        []byte(content),
+		Session:    &Session{Values: map[interface{}]interface{}{"k": "v"}},
+	}
+	c := m.Clone()
+	if !reflect.DeepEqual(c, m) {
+		t.Fatal(fmt.Errorf("%v != %v", c, m))
+	}
+	c.To[0] = testEmail3
+	c.Recipients[0].Params["NOTIFY"] = "SUCCESS"
+	c.Params["BODY"] = "7BIT"
+	c.Raw[0] = 'x'
+	c.Session.Values["k"] = "x"
+	if m.To[0] != testEmail2 ||
+		m.Recipients[0].Params["NOTIFY"] != "NEVER" ||
+		m.Params["BODY"] != "8BITMIME" ||
+		m.Raw[0] != content[0] ||
+		m.Session.Values["k"] != "v" {
+		t.Fatal(errors.New("clone shares data with the original"))
+	}
+}
+
+func TestMessageSplit(t *testing.T) {
+	m := &Message{
+		From: testEmail1,
+		To:   []string{"a@example.com", "b@example.org", "c@example.com"},
+		Recipients: []*Recipient{
+			{Address: "a@example.com"},
+			{Address: "b@example.org"},
+			{Address: "c@example.com"},
+		},
+		Body: content,
+	}
+	messages := m.Split(func(r *Recipient) string {
+		return r.Address[strings.LastIndex(r.Address, "@")+1:]
+	})
+	if len(messages) != 2 {
+		t.Fatalf("unexpected number of messages %d", len(messages))
+	}
+	for i, to := range [][]string{
+		{"a@example.com", "c@example.com"},
+		{"b@example.org"},
+	} {
+		if !reflect.DeepEqual(messages[i].To, to) || len(messages[i].Recipients) != len(to) {
+			t.Fatalf("%v != %v", messages[i].To, to)
+		}
+		if messages[i].Body != content {
+			t.Fatal(errors.New("content should have been copied"))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// headerValue returns the value with control characters replaced by "?" so
+// that values supplied by the client cannot end the header field and begin
+// another.
+func headerValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// metadataHeaders returns the headers recording facts about the session if
+// MetadataPrefix is set. Those that do not apply to the session (such as the
+// cipher suite when TLS was not used) are omitted.
+func (c *Client) metadataHeaders() string {
+	var (
+		p = c.config.MetadataPrefix
+		h string
+	)
+	if a, ok := c.session.RemoteAddr.(*net.TCPAddr); ok {
+		h += fmt.Sprintf("%sClient-IP: %s\r\n", p, a.IP)
+	}
+	if len(c.session.Helo) != 0 {
+		h += fmt.Sprintf("%sHelo: %s\r\n", p, headerValue(c.session.Helo))
+	}
+	if s := c.session.TLS; s != nil {
+		h += fmt.Sprintf("%sTLS-Cipher: %s\r\n", p, tls.CipherSuiteName(s.CipherSuite))
+	}
+	if len(c.session.AuthUser) != 0 {
+		h += fmt.Sprintf("%sAuth-User: %s\r\n", p, headerValue(c.session.AuthUser))
+	}
+	switch {
+	case len(c.session.Listener) != 0:
+		h += fmt.Sprintf("%sListener: %s\r\n", p, c.session.Listener)
+	case c.session.LocalAddr != nil:
+		h += fmt.Sprintf("%sListener: %s\r\n", p, c.session.LocalAddr)
+	}
+	return h
+}
+
+// headerFilter is a writer that removes the header fields whose names begin
+// with prefix (compared without regard to case) from the header section of a
+// message, along with their continuation lines, and passes everything else
+// through to w. Content is buffered until the end of each line.
+type headerFilter struct {
+	w      io.Writer
+	prefix string
+	line   []byte
+	body   bool
+	skip   bool
+}
+
+// Write filters the content one line at a time until the end of the header
+// section is reached.
+func (f *headerFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		if f.body {
+			_, err := f.w.Write(p)
+			return n, err
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			f.line = append(f.line, p...)
+			break
+		}
+		f.line = append(f.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := f.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flush writes the buffered line unless it belongs to a field being removed.
+func (f *headerFilter) flush() error {
+	line := f.line
+	f.line = f.line[:0]
+	switch {
+	case len(line) == 0:
+		return nil
+	case len(bytes.TrimRight(line, "\r\n")) == 0:
+		f.body = true
+	case line[0] == ' ' || line[0] == '\t':
+		if f.skip {
+			return nil
+		}
+	default:
+		f.skip = len(line) >= len(f.prefix) &&
+			strings.EqualFold(string(line[:len(f.prefix)]), f.prefix)
+		if f.skip {
+			return nil
+		}
+	}
+	_, err := f.w.Write(line)
+	return err
+}
+
+// stripHeaders removes the header fields whose names begin with prefix from
+// the message.
+func stripHeaders(body, prefix string) string {
+	var (
+		b bytes.Buffer
+		f = &headerFilter{w: &b, prefix: prefix}
+	)
+	f.Write([]byte(body))
+	f.flush()
+	return b.String()
+}
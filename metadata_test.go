@@ -0,0 +1,43 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestStripHeaders(t *testing.T) {
+	for _, v := range []struct {
+		body   string
+		result string
+	}{
+		{
+			"Subject: test\r\n\r\nbody",
+			"Subject: test\r\n\r\nbody",
+		},
+		{
+			"x-smtpsrv-client-ip: 192.0.2.1\r\nSubject: test\r\n\r\nbody",
+			"Subject: test\r\n\r\nbody",
+		},
+		{
+			"Subject: test\r\nX-SMTPSrv-Helo: a\r\n\tb\r\nTo: c\r\n\r\nbody",
+			"Subject: test\r\nTo: c\r\n\r\nbody",
+		},
+		{
+			"Subject: test\r\n\r\nX-SMTPSrv-Helo: a",
+			"Subject: test\r\n\r\nX-SMTPSrv-Helo: a",
+		},
+		{
+			"Subject: test\r\nX-SMTPSrv-Helo: a",
+			"Subject: test\r\n",
+		},
+	} {
+		if r := stripHeaders(v.body, "X-SMTPSrv-"); r != v.result {
+			t.Fatalf("%q != %q", r, v.result)
+		}
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	if v := headerValue("user\r\nX-SMTPSrv-Helo: a\tb"); v != "user??X-SMTPSrv-Helo: a?b" {
+		t.Fatalf("unexpected value %q", v)
+	}
+}
@@ -0,0 +1,207 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxPartDepth limits how deeply multipart parts may be nested unless
+// DecodeLimits specifies otherwise.
+const maxPartDepth = 10
+
+// Part is a single part of a MIME message (RFC 2045). Multipart parts contain
+// the parts nested within them, while the content of other parts is decoded
+// according to Content-Transfer-Encoding.
+type Part struct {
+	Header textproto.MIMEHeader
+	// Media type in lowercase ("text/plain" if none was specified) and its
+	// parameters, with names in lowercase
+	ContentType string
+	Params      map[string]string
+	Content     []byte
+	Parts       []*Part
+}
+
+// Walk invokes fn for the part and each of the parts nested within it, in
+// the order they appear in the message.
+func (p *Part) Walk(fn func(p *Part)) {
+	fn(p)
+	for _, c := range p.Parts {
+		c.Walk(fn)
+	}
+}
+
+// decodeContent reads the content of a part, decoding it if necessary.
+// Unknown encodings (including 7bit, 8bit, and binary) are left as-is.
+func (d *decoder) decodeContent(h textproto.MIMEHeader, contentType string, depth int, raw io.Reader) ([]byte, error) {
+	var (
+		encoded           = &countingReader{r: raw}
+		r       io.Reader = encoded
+	)
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return d.read(contentType, depth, encoded, r)
+}
+
+// parsePart parses the part with the specified header and content, including
+// any parts nested within it.
+func (d *decoder) parsePart(h textproto.MIMEHeader, r io.Reader, depth int) (*Part, error) {
+	p := &Part{
+		Header:      h,
+		ContentType: "text/plain",
+		Params:      map[string]string{},
+	}
+	if v := h.Get("Content-Type"); len(v) != 0 {
+		if t, params, err := mime.ParseMediaType(v); err == nil {
+			p.ContentType = t
+			p.Params = params
+		}
+	}
+	if err := d.limits.Check(p.ContentType, depth, 0, 0); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(p.ContentType, "multipart/") && len(p.Params["boundary"]) != 0 {
+		mr := multipart.NewReader(r, p.Params["boundary"])
+		for {
+			c, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			child, err := d.parsePart(c.Header, c, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			p.Parts = append(p.Parts, child)
+		}
+		return p, nil
+	}
+	b, err := d.decodeContent(h, p.ContentType, depth, r)
+	if err != nil {
+		return nil, err
+	}
+	p.Content = b
+	return p, nil
+}
+
+// CharsetReader, if set, is used by Part.Text to convert text in charsets
+// other than UTF-8, US-ASCII, and ISO-8859-1 to UTF-8. It has the same
+// signature as the function in mime.WordDecoder, so a package such as
+// golang.org/x/net/html/charset can be used.
+var CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+var errUnknownCharset = errors.New("unsupported charset")
+
+// Disposition returns the disposition of the part in lowercase, such as
+// "inline" or "attachment", or an empty string if none was specified.
+func (p *Part) Disposition() string {
+	d, _, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return d
+}
+
+// Filename returns the name suggested for the part, if any. The filename
+// parameter of Content-Disposition is preferred, with the name parameter of
+// Content-Type used for older clients. Encoded words (RFC 2047) are decoded.
+func (p *Part) Filename() string {
+	var name string
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if len(name) == 0 {
+		name = p.Params["name"]
+	}
+	dec := &mime.WordDecoder{CharsetReader: CharsetReader}
+	if d, err := dec.DecodeHeader(name); err == nil {
+		name = d
+	}
+	return name
+}
+
+// IsAttachment determines whether the part is an attachment rather than part
+// of the body, either because it is marked as one or because it is not text
+// and has a filename.
+func (p *Part) IsAttachment() bool {
+	switch p.Disposition() {
+	case "attachment":
+		return true
+	case "inline":
+		return false
+	}
+	return len(p.Filename()) != 0 && !strings.HasPrefix(p.ContentType, "text/")
+}
+
+// Text returns the content of the part converted to UTF-8 according to its
+// charset parameter.
+func (p *Part) Text() (string, error) {
+	switch charset := strings.ToLower(p.Params["charset"]); charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(p.Content), nil
+	case "iso-8859-1", "latin1":
+		r := make([]rune, len(p.Content))
+		for i, b := range p.Content {
+			r[i] = rune(b)
+		}
+		return string(r), nil
+	default:
+		if CharsetReader == nil {
+			return "", errUnknownCharset
+		}
+		cr, err := CharsetReader(charset, bytes.NewReader(p.Content))
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadAll(cr)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+// Parts parses the message and returns the parts that contain content (that
+// is, all parts other than multipart containers) in the order they appear.
+func (m *Message) Parts() ([]*Part, error) {
+	p, err := m.Parse()
+	if err != nil {
+		return nil, err
+	}
+	parts := []*Part{}
+	p.MIME.Walk(func(part *Part) {
+		if len(part.Parts) == 0 && !strings.HasPrefix(part.ContentType, "multipart/") {
+			parts = append(parts, part)
+		}
+	})
+	return parts, nil
+}
+
+// Attachments parses the message and returns the parts that are attachments.
+func (m *Message) Attachments() ([]*Part, error) {
+	parts, err := m.Parts()
+	if err != nil {
+		return nil, err
+	}
+	attachments := []*Part{}
+	for _, p := range parts {
+		if p.IsAttachment() {
+			attachments = append(attachments, p)
+		}
+	}
+	return attachments, nil
+}
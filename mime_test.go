@@ -0,0 +1,66 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	m := &Message{
+		Body: "MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+			"\r\n" +
+			"--outer\r\n" +
+			"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+			"\r\n" +
+			"--inner\r\n" +
+			"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"caf=E9\r\n" +
+			"--inner\r\n" +
+			"Content-Type: text/html; charset=utf-8\r\n" +
+			"\r\n" +
+			"<p>caf\xc3\xa9</p>\r\n" +
+			"--inner--\r\n" +
+			"--outer\r\n" +
+			"Content-Type: application/pdf; name=\"old.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"=?utf-8?q?r=C3=A9sum=C3=A9.pdf?=\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"JVBERi0=\r\n" +
+			"--outer\r\n" +
+			"Content-Type: text/plain; charset=koi8-r\r\n" +
+			"\r\n" +
+			"text\r\n" +
+			"--outer--\r\n",
+	}
+	parts, err := m.Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("unexpected number of parts %d", len(parts))
+	}
+	for i, exp := range []string{"café", "<p>café</p>"} {
+		s, err := parts[i].Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != exp {
+			t.Fatalf("%q != %q", s, exp)
+		}
+	}
+	if _, err := parts[3].Text(); err == nil {
+		t.Fatal("unknown charset should not have been decoded")
+	}
+	attachments, err := m.Attachments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("unexpected number of attachments %d", len(attachments))
+	}
+	if a := attachments[0]; a.Filename() != "résumé.pdf" || string(a.Content) != "%PDF-" {
+		t.Fatalf("unexpected attachment %q %q", a.Filename(), a.Content)
+	}
+}
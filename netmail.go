@@ -0,0 +1,64 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// Reader returns a reader for the content of the message, including the
+// headers added by the server. It can be passed to other parsers (such as
+// enmime.ReadEnvelope) without copying the content.
+func (m *Message) Reader() io.Reader {
+	return strings.NewReader(m.Body)
+}
+
+// MailMessage parses the headers of the message and returns it as a
+// *mail.Message, whose body reads the content following the headers.
+func (m *Message) MailMessage() (*mail.Message, error) {
+	return mail.ReadMessage(m.Reader())
+}
+
+// MailMessage returns the parsed message as a *mail.Message. The headers
+// are shared with the parsed message.
+func (p *ParsedMessage) MailMessage() *mail.Message {
+	return &mail.Message{
+		Header: p.Header,
+		Body:   strings.NewReader(p.Body),
+	}
+}
+
+// NewMessageFromMail creates a message with the content of a *mail.Message,
+// reading its body in the process, so that it can be passed to a Handler
+// (in tests, for example). The headers are written in order by name, since
+// mail.Header does not preserve their original order. The envelope and
+// session are left empty.
+func NewMessageFromMail(msg *mail.Message) (*Message, error) {
+	var (
+		b    bytes.Buffer
+		keys = make([]string, 0, len(msg.Header))
+	)
+	for k := range msg.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range msg.Header[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	b.Write(body)
+	return &Message{
+		Body: b.String(),
+		Raw:  b.Bytes(),
+		Size: int64(b.Len()),
+	}, nil
+}
@@ -0,0 +1,45 @@
+package smtpsrv
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestMailMessage(t *testing.T) {
+	m := &Message{
+		Body: "Subject: test\r\nFrom: a@example.com\r\n\r\nbody",
+	}
+	msg, err := m.MailMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := msg.Header.Get("Subject"); s != "test" {
+		t.Fatalf("%q != %q", s, "test")
+	}
+	b, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "body" {
+		t.Fatalf("%q != %q", b, "body")
+	}
+	// Converting back preserves the content, with headers ordered by name
+	msg, err = m.MailMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewMessageFromMail(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := "From: a@example.com\r\nSubject: test\r\n\r\nbody"; n.Body != b {
+		t.Fatalf("%q != %q", n.Body, b)
+	}
+	p, err := n.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.MailMessage().Header.Get("From"); s != "a@example.com" {
+		t.Fatalf("%q != %q", s, "a@example.com")
+	}
+}
@@ -0,0 +1,26 @@
+package smtpsrv
+
+import (
+	"time"
+)
+
+// pause delays the session by the duration returned by the Pace function, if
+// one is set, unless the transaction is allowlisted. False is returned if the
+// server was shut down while waiting.
+func (c *Client) pause() bool {
+	if c.config.Pace == nil || c.Allowlisted() {
+		return true
+	}
+	d := c.config.Pace(c)
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,179 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errInvalidParam = errors.New("invalid parameter")
+
+// paramHandler validates the value of an ESMTP parameter. If the value is
+// not acceptable, a reply is sent to the client and false is returned.
+type paramHandler func(c *Client, value string) bool
+
+// mailParams lists the parameters that may be supplied with MAIL.
+var mailParams = map[string]paramHandler{
+	"SIZE":     (*Client).checkSizeParam,
+	"AUTH":     acceptParam,
+	"BODY":     (*Client).checkBodyParam,
+	"SMTPUTF8": checkFlagParam,
+	"RET":      (*Client).checkRetParam,
+	"ENVID":    (*Client).checkEnvIDParam,
+}
+
+// rcptParams lists the parameters that may be supplied with RCPT.
+var rcptParams = map[string]paramHandler{
+	"NOTIFY": (*Client).checkNotifyParam,
+	"ORCPT":  (*Client).checkORcptParam,
+}
+
+// acceptParam accepts any value for a parameter.
+func acceptParam(c *Client, value string) bool {
+	return true
+}
+
+// checkFlagParam ensures that no value was supplied for a parameter that
+// doesn't take one.
+func checkFlagParam(c *Client, value string) bool {
+	if len(value) != 0 {
+		c.reply("param.value")
+		return false
+	}
+	return true
+}
+
+// splitPath separates the path at the start of a MAIL or RCPT argument from
+// the ESMTP parameters that may follow it.
+func splitPath(b []byte) (string, [][]byte) {
+	b = bytes.TrimSpace(b)
+	i := len(b)
+	if bytes.HasPrefix(b, []byte("<")) {
+		// Skip over quoted local parts, which may contain ">"
+		quoted := false
+	loop:
+		for j := 1; j < len(b); j++ {
+			switch {
+			case quoted && b[j] == '\\':
+				j++
+			case b[j] == '"':
+				quoted = !quoted
+			case !quoted && b[j] == '>':
+				i = j + 1
+				break loop
+			}
+		}
+	} else if j := bytes.IndexByte(b, ' '); j != -1 {
+		i = j
+	}
+	return string(b[:i]), bytes.Fields(b[i:])
+}
+
+// isKeyword determines whether s is a valid esmtp-keyword (RFC 5321 section
+// 4.1.2), which consists of letters, digits, and hyphens and cannot begin
+// with a hyphen.
+func isKeyword(s string) bool {
+	if len(s) == 0 || s[0] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isValue determines whether s is a valid esmtp-value, which consists of
+// printable characters other than "=".
+func isValue(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		if r < 33 || r > 126 || r == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseParams parses a list of "keyword[=value]" parameters. Keywords are
+// converted to uppercase and parameters without a value are given an empty
+// value. The map is nil if there are no parameters.
+func parseParams(params [][]byte) (map[string]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, p := range params {
+		var (
+			kv    = strings.SplitN(string(p), "=", 2)
+			key   = strings.ToUpper(kv[0])
+			value string
+		)
+		if !isKeyword(key) {
+			return nil, errInvalidParam
+		}
+		if len(kv) == 2 {
+			if !isValue(kv[1]) {
+				return nil, errInvalidParam
+			}
+			value = kv[1]
+		}
+		if _, ok := m[key]; ok {
+			return nil, errInvalidParam
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// checkParams ensures that each of the parameters is recognized and that its
+// value is acceptable, replying to the client if not.
+func (c *Client) checkParams(handlers map[string]paramHandler, params map[string]string) bool {
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h, ok := handlers[k]
+		if !ok {
+			c.reply("param.unknown", k)
+			return false
+		}
+		if !h(c, params[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSizeParam ensures that the size declared by the client does not exceed
+// the maximum message size.
+func (c *Client) checkSizeParam(value string) bool {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		c.reply("param.invalid", "SIZE")
+		return false
+	}
+	if c.config.MaxMessageSize != 0 && size > c.config.MaxMessageSize {
+		c.reply("mail.too-large")
+		return false
+	}
+	return true
+}
+
+// checkBodyParam ensures that the body type declared by the client is one of
+// 7BIT, 8BITMIME (RFC 6152), or BINARYMIME (RFC 3030).
+func (c *Client) checkBodyParam(value string) bool {
+	switch strings.ToUpper(value) {
+	case "7BIT", "8BITMIME", "BINARYMIME":
+		return true
+	}
+	c.reply("param.invalid", "BODY")
+	return false
+}
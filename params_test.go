@@ -0,0 +1,12 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	path, params := splitPath([]byte(` <"a>b"@example.com> SIZE=10`))
+	if path != `<"a>b"@example.com>` || len(params) != 1 {
+		t.Fatalf("unexpected path %s and parameters %q", path, params)
+	}
+}
@@ -0,0 +1,64 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ParsedMessage contains the headers of a message along with structured
+// information derived from them. Messages are not parsed by the server; call
+// Parse on a received message to obtain one.
+type ParsedMessage struct {
+	Header mail.Header
+	// Hops recorded in the Received headers, from the most recent to the
+	// earliest
+	Received []*Hop
+	// Content following the headers
+	Body string
+	// Mailing list headers or nil if there are none
+	List *ListHeaders
+	// MIME structure of the message, with the message itself as the root
+	MIME *Part
+	// Calendars found in text/calendar parts, such as meeting invitations
+	Calendars []*Calendar
+	// Signature or encryption applied to the message or nil if there is none
+	Security *Security
+}
+
+// Parse parses the headers (RFC 5322) and MIME structure of the message.
+func (m *Message) Parse() (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{limits: m.DecodeLimits}
+	root, err := d.parsePart(textproto.MIMEHeader(msg.Header), bytes.NewReader(b), 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &ParsedMessage{
+		Header:   msg.Header,
+		Received: parseReceivedChain(msg.Header),
+		Body:     string(b),
+		List:     parseListHeaders(msg.Header),
+		MIME:     root,
+		Security: detectSecurity(root, b),
+	}
+	root.Walk(func(part *Part) {
+		if part.ContentType == "text/calendar" {
+			c := parseCalendar(string(part.Content))
+			if len(c.Method) == 0 {
+				c.Method = strings.ToUpper(part.Params["method"])
+			}
+			p.Calendars = append(p.Calendars, c)
+		}
+	})
+	return p, nil
+}
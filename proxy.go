@@ -0,0 +1,142 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+
+	// proxySignature begins each version 2 header
+	proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// parseProxyHeader reads the PROXY protocol header sent by a load balancer
+// before the SMTP session begins. Both the text (version 1) and binary
+// (version 2) forms are accepted. The address of the original client is
+// returned, or nil if the header indicates that the connection did not
+// originate from a proxied client (such as a health check).
+func parseProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxySignature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, proxySignature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads a header such as:
+//
+//	PROXY TCP4 192.0.2.1 192.0.2.2 56324 25
+//
+// The header may not exceed 107 bytes, including the CRLF.
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var l []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, c)
+		if c == '\n' {
+			break
+		}
+		if len(l) == 107 {
+			return nil, errProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(l, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(l[:len(l)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header, which consists of the signature,
+// the version and command, the address family, and the length of the
+// addresses that follow. Any TLVs following the addresses are ignored.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	var (
+		verCmd = h[12]
+		family = h[13]
+		data   = make([]byte, binary.BigEndian.Uint16(h[14:16]))
+	)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL - the connection was made by the proxy itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, errProxyHeader
+	}
+	var ipLen int
+	switch family {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		// Unspecified or unsupported family - use the real address
+		return nil, nil
+	}
+	if len(data) < ipLen*2+4 {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(data[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(data[ipLen*2:])),
+	}, nil
+}
+
+// readProxyHeader reads the PROXY protocol header from the client and uses
+// the address it contains as the address of the client. The client is
+// disconnected without a reply if the header is missing or invalid.
+func (c *Client) readProxyHeader() bool {
+	if err := c.prepareRead(c.greetingTimeout()); err != nil {
+		return false
+	}
+	addr, err := parseProxyHeader(c.reader)
+	if err != nil {
+		return false
+	}
+	if addr != nil {
+		c.session.RemoteAddr = addr
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	v2 := func(verCmd, family byte, data ...byte) string {
+		h := append([]byte{}, proxySignature...)
+		h = append(h, verCmd, family, 0, byte(len(data)))
+		return string(append(h, data...))
+	}
+	for _, v := range []struct {
+		header string
+		addr   string
+		valid  bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 192.0.2.2 56324 25\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 port 25\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1\r\n", "", false},
+		{"EHLO localhost\r\n", "", false},
+		{v2(0x21, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0, 25), "192.0.2.1:56324", true},
+		{v2(0x20, 0x00), "", true},
+		{v2(0x21, 0x11, 192, 0, 2, 1), "", false},
+		{v2(0x11, 0x11, 192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0, 25), "", false},
+	} {
+		r := bufio.NewReader(bytes.NewReader([]byte(v.header + "EHLO localhost\r\n")))
+		addr, err := parseProxyHeader(r)
+		if !v.valid {
+			if err == nil {
+				t.Fatalf("%q should not have been accepted", v.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v.addr) == 0 {
+			if addr != nil {
+				t.Fatalf("%q: unexpected address %s", v.header, addr)
+			}
+		} else if addr == nil || addr.String() != v.addr {
+			t.Fatalf("%q: %v != %s", v.header, addr, v.addr)
+		}
+		// The remainder of the stream must be left intact
+		if l, _ := r.ReadString('\n'); l != "EHLO localhost\r\n" {
+			t.Fatalf("%q: unexpected remainder %q", v.header, l)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	var (
+		addrs  = make(chan net.Addr, 1)
+		s, err = NewServer(&Config{
+			Addr:          "127.0.0.1:0",
+			ProxyProtocol: true,
+			Extensions: func(c *Client, ext []string) []string {
+				addrs <- c.RemoteAddr()
+				return ext
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\nEHLO localhost\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-addrs; addr.String() != "192.0.2.1:56324" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+	c.Close()
+	s.Close(false)
+}
+
+func TestProxyProtocolImplicitTLS(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		addrs = make(chan net.Addr, 1)
+		s     = New(&Config{
+			TLSConfig:     tlsConfig,
+			ProxyProtocol: true,
+			OnConnect: func(c *Client) error {
+				addrs <- c.RemoteAddr()
+				return nil
+			},
+		})
+	)
+	l, err := s.listen(&Listener{Addr: "127.0.0.1:0", ImplicitTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 465\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-addrs; addr.String() != "192.0.2.1:56324" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
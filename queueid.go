@@ -0,0 +1,108 @@
+package smtpsrv
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// IDGenerator generates the queue IDs assigned to messages. IDs must be
+// unique and NewID must be safe for concurrent use.
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc allows an ordinary function to be used as an IDGenerator.
+type IDGeneratorFunc func() string
+
+// NewID invokes f().
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+var (
+	// QueueIDHex generates the default IDs, which consist of 24 hexadecimal
+	// digits and sort in the order in which they were generated.
+	QueueIDHex IDGenerator = IDGeneratorFunc(newQueueID)
+	// QueueIDPostfix generates IDs resembling the short queue IDs used by
+	// Postfix, which consist of 11 hexadecimal digits (such as "3F2A41C0A2B").
+	// Unlike the others, they do not sort in the order they were generated.
+	QueueIDPostfix IDGenerator = IDGeneratorFunc(newPostfixID)
+	// QueueIDULID generates ULIDs, which sort in the order they were
+	// generated to the millisecond.
+	QueueIDULID IDGenerator = IDGeneratorFunc(newULID)
+	// QueueIDUUIDv7 generates version 7 UUIDs (RFC 9562), which sort in the
+	// order they were generated to the millisecond.
+	QueueIDUUIDv7 IDGenerator = IDGeneratorFunc(newUUIDv7)
+)
+
+// crockford is the alphabet used to encode ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newQueueID generates a unique identifier for a message. It consists of the
+// current time in nanoseconds followed by random bytes, both encoded as
+// fixed-width hexadecimal, so that identifiers sort in the order in which
+// they were generated.
+func newQueueID() string {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	rand.Read(b[8:])
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// newPostfixID generates an identifier like the ones used by Postfix, which
+// combine the microseconds of the current time (5 digits) with the inode of
+// the queue file. Since there is no queue file, random digits are used
+// instead.
+func newPostfixID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("%05X%06X", time.Now().Nanosecond()/1000, b)
+}
+
+// newULID generates a ULID, which consists of a 48-bit timestamp in
+// milliseconds followed by 80 random bits, encoded as 26 characters of
+// Crockford's base32.
+func newULID() string {
+	b := make([]byte, 16)
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b, ms<<16)
+	rand.Read(b[6:])
+	var (
+		hi = binary.BigEndian.Uint64(b[:8])
+		lo = binary.BigEndian.Uint64(b[8:])
+		s  = make([]byte, 26)
+	)
+	// 128 bits are encoded from the least significant end, with the first
+	// character holding the 3 most significant bits
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s)
+}
+
+// newUUIDv7 generates a version 7 UUID, which consists of a 48-bit timestamp
+// in milliseconds followed by random bits and the version and variant.
+func newUUIDv7() string {
+	b := make([]byte, 16)
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b, ms<<16)
+	rand.Read(b[6:])
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:])
+}
+
+// queueID assigns an ID to a message using the configured generator.
+func (c *Client) queueID() string {
+	if c.config.QueueIDs != nil {
+		return c.config.QueueIDs.NewID()
+	}
+	return newQueueID()
+}
@@ -0,0 +1,48 @@
+package smtpsrv
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestQueueID(t *testing.T) {
+	ids := map[string]bool{}
+	last := ""
+	for i := 0; i < 1000; i++ {
+		id := newQueueID()
+		if len(id) != 24 {
+			t.Fatalf("unexpected length %d", len(id))
+		}
+		if id < last {
+			t.Fatalf("%s sorts before %s", id, last)
+		}
+		if ids[id] {
+			t.Fatalf("duplicate %s", id)
+		}
+		ids[id] = true
+		last = id
+	}
+}
+
+func TestQueueIDFormats(t *testing.T) {
+	for _, v := range []struct {
+		generator IDGenerator
+		pattern   *regexp.Regexp
+	}{
+		{QueueIDHex, regexp.MustCompile(`^[0-9A-F]{24}$`)},
+		{QueueIDPostfix, regexp.MustCompile(`^[0-9A-F]{11}$`)},
+		{QueueIDULID, regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+		{QueueIDUUIDv7, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+	} {
+		if id := v.generator.NewID(); !v.pattern.MatchString(id) {
+			t.Fatalf("%s does not match %s", id, v.pattern)
+		}
+	}
+	// Timestamps are encoded first so that IDs generated later sort after
+	a := QueueIDULID.NewID()
+	time.Sleep(2 * time.Millisecond)
+	if b := QueueIDULID.NewID(); b <= a {
+		t.Fatalf("%s sorts before %s", b, a)
+	}
+}
@@ -0,0 +1,102 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var errBareLF = errors.New("bare LF received")
+
+// Quirk identifies a known deviation from the standards by clients, which the
+// server can be configured to tolerate (see Config.Quirks). Quirks are
+// combined with bitwise OR.
+type Quirk int
+
+const (
+	// HELO or EHLO without a hostname, in which case the client is treated
+	// as having supplied the address literal of its IP address
+	QuirkHeloWithoutHostname Quirk = 1 << iota
+	// Lines ending in a bare LF instead of CRLF
+	QuirkBareLF
+	// Spaces between "FROM:" or "TO:" and the path, as in
+	// "MAIL FROM: <user@example.com>"
+	QuirkSpaceAfterColon
+	// 8-bit characters in the headers of a message sent without SMTPUTF8
+	QuirkEightBitHeaders
+	// Tolerate none of the quirks in place of DefaultQuirks
+	QuirkNone
+)
+
+// DefaultQuirks are the quirks tolerated when Config.Quirks is not set, which
+// are those accepted by earlier versions.
+const DefaultQuirks = QuirkHeloWithoutHostname | QuirkBareLF |
+	QuirkSpaceAfterColon | QuirkEightBitHeaders
+
+// quirkNames are the names of the quirks as returned by String.
+var quirkNames = []struct {
+	quirk Quirk
+	name  string
+}{
+	{QuirkHeloWithoutHostname, "helo-without-hostname"},
+	{QuirkBareLF, "bare-lf"},
+	{QuirkSpaceAfterColon, "space-after-colon"},
+	{QuirkEightBitHeaders, "8bit-headers"},
+}
+
+// Names returns the names of the quirks (such as "bare-lf").
+func (q Quirk) Names() []string {
+	var names []string
+	for _, n := range quirkNames {
+		if q&n.quirk != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// String returns the names of the quirks separated by commas.
+func (q Quirk) String() string {
+	return strings.Join(q.Names(), ",")
+}
+
+// quirk records that the client exhibited the quirk and determines whether
+// it is tolerated.
+func (c *Client) quirk(q Quirk) bool {
+	c.session.Quirks |= q
+	quirks := c.config.Quirks
+	if quirks == 0 {
+		quirks = DefaultQuirks
+	}
+	return quirks&q != 0
+}
+
+// eightBitHeaders determines whether a line in the header section of a
+// message contains 8-bit characters that are not permitted because SMTPUTF8
+// was not requested, recording the quirk if so.
+func (c *Client) eightBitHeaders(line []byte) bool {
+	if _, ok := c.mailParams["SMTPUTF8"]; ok || isASCII(string(line)) {
+		return false
+	}
+	return !c.quirk(QuirkEightBitHeaders)
+}
+
+// eightBitHeaderSection checks each line in the header section of a message
+// sent with BDAT for 8-bit characters that are not permitted.
+func (c *Client) eightBitHeaderSection(b []byte) bool {
+	for len(b) != 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			i = len(b) - 1
+		}
+		line := bytes.TrimRight(b[:i+1], "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		if c.eightBitHeaders(line) {
+			return true
+		}
+		b = b[i+1:]
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestQuirkNames(t *testing.T) {
+	for _, v := range []struct {
+		quirks Quirk
+		name   string
+	}{
+		{0, ""},
+		{QuirkBareLF, "bare-lf"},
+		{QuirkHeloWithoutHostname | QuirkEightBitHeaders, "helo-without-hostname,8bit-headers"},
+		{DefaultQuirks, "helo-without-hostname,bare-lf,space-after-colon,8bit-headers"},
+	} {
+		if n := v.quirks.String(); n != v.name {
+			t.Fatalf("%q != %q", n, v.name)
+		}
+	}
+}
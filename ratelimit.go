@@ -0,0 +1,133 @@
+package smtpsrv
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateEvent identifies the kind of event being rate limited.
+type RateEvent int
+
+const (
+	// A command sent by the client
+	RateCommand RateEvent = iota
+	// A message, counted when MAIL is accepted
+	RateMessage
+)
+
+// RateLimiter limits the rate at which a client may send commands and
+// messages. Allow consumes one unit of the allowance for the event and
+// returns false if none remains. Implementations must be safe for concurrent
+// use and may share state between servers (in Redis, for example).
+type RateLimiter interface {
+	Allow(ip net.IP, event RateEvent) bool
+}
+
+// RateLimiterFunc allows an ordinary function to be used as a RateLimiter.
+type RateLimiterFunc func(ip net.IP, event RateEvent) bool
+
+// Allow invokes f(ip, event).
+func (f RateLimiterFunc) Allow(ip net.IP, event RateEvent) bool {
+	return f(ip, event)
+}
+
+// bucket is a token bucket for a single address and event.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketLimiter is the RateLimiter returned by NewRateLimiter.
+type tokenBucketLimiter struct {
+	mutex   sync.Mutex
+	rates   [2]float64
+	bursts  [2]float64
+	buckets [2]map[string]*bucket
+	calls   int
+}
+
+// pruneInterval is the number of calls to Allow between removals of full
+// buckets, which keeps memory bounded as addresses come and go.
+const pruneInterval = 10000
+
+// NewRateLimiter creates a RateLimiter that uses token buckets kept in
+// memory, one for each client IP address and event. Each bucket holds one
+// second's worth of commands or one hour's worth of messages (at least one)
+// so that short bursts are allowed. A rate of zero is unlimited.
+func NewRateLimiter(commandsPerSecond, messagesPerHour float64) RateLimiter {
+	l := &tokenBucketLimiter{
+		rates: [2]float64{commandsPerSecond, messagesPerHour / 3600},
+		bursts: [2]float64{
+			math.Max(commandsPerSecond, 1),
+			math.Max(messagesPerHour, 1),
+		},
+	}
+	for i := range l.buckets {
+		l.buckets[i] = map[string]*bucket{}
+	}
+	return l
+}
+
+// refill adds the tokens accumulated since the bucket was last used.
+func (l *tokenBucketLimiter) refill(b *bucket, event RateEvent, now time.Time) {
+	b.tokens = math.Min(
+		l.bursts[event],
+		b.tokens+now.Sub(b.last).Seconds()*l.rates[event],
+	)
+	b.last = now
+}
+
+// Allow takes a token from the bucket for the address and event.
+func (l *tokenBucketLimiter) Allow(ip net.IP, event RateEvent) bool {
+	if event < 0 || int(event) >= len(l.rates) || l.rates[event] <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if l.calls++; l.calls%pruneInterval == 0 {
+		l.prune(now)
+	}
+	var (
+		key = ip.String()
+		b   = l.buckets[event][key]
+	)
+	if b == nil {
+		b = &bucket{tokens: l.bursts[event], last: now}
+		l.buckets[event][key] = b
+	}
+	l.refill(b, event, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes the buckets that have refilled completely, since they are
+// indistinguishable from new ones.
+func (l *tokenBucketLimiter) prune(now time.Time) {
+	for event, buckets := range l.buckets {
+		for key, b := range buckets {
+			l.refill(b, RateEvent(event), now)
+			if b.tokens >= l.bursts[event] {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// allowRate determines whether the client may proceed with the event
+// according to RateLimiter.
+func (c *Client) allowRate(event RateEvent) bool {
+	if c.config.RateLimiter == nil {
+		return true
+	}
+	a, ok := c.session.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return c.config.RateLimiter.Allow(a.IP, event)
+}
@@ -0,0 +1,40 @@
+package smtpsrv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		l   = NewRateLimiter(2, 1)
+		ip1 = net.ParseIP("192.0.2.1")
+		ip2 = net.ParseIP("192.0.2.2")
+	)
+	for i, v := range []struct {
+		ip      net.IP
+		event   RateEvent
+		allowed bool
+	}{
+		{ip1, RateCommand, true},
+		{ip1, RateCommand, true},
+		{ip1, RateCommand, false},
+		{ip2, RateCommand, true},
+		{ip1, RateMessage, true},
+		{ip1, RateMessage, false},
+		{ip2, RateMessage, true},
+	} {
+		if a := l.Allow(v.ip, v.event); a != v.allowed {
+			t.Fatalf("%d: %v != %v", i, a, v.allowed)
+		}
+	}
+	// Buckets are removed once they have refilled
+	b := l.(*tokenBucketLimiter)
+	b.prune(time.Now().Add(time.Hour))
+	for _, buckets := range b.buckets {
+		if len(buckets) != 0 {
+			t.Fatalf("%d buckets remaining", len(buckets))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// protocol returns the value of the "with" clause of the Received header,
+// using the names registered for SMTP and LMTP (RFC 3848).
+func (c *Client) protocol() string {
+	var p string
+	switch {
+	case c.config.LMTP:
+		p = "LMTP"
+	case c.extended:
+		p = "ESMTP"
+	default:
+		return "SMTP"
+	}
+	if c.session.TLS != nil {
+		p += "S"
+	}
+	if len(c.session.AuthUser) != 0 {
+		p += "A"
+	}
+	return p
+}
+
+// receivedHeader returns the Received header (RFC 5321 section 4.4) for the
+// message. The recipient is only included if there is exactly one, since
+// listing them all would disclose blind carbon copies.
+func (c *Client) receivedHeader(m *Message) string {
+	from := fmt.Sprintf("from %s", c.session.Helo)
+	if a, ok := c.session.RemoteAddr.(*net.TCPAddr); ok {
+		from += fmt.Sprintf(" ([%s])", a.IP)
+	}
+	lines := []string{
+		from,
+		fmt.Sprintf("by %s (%s) with %s id %s", c.config.Banner, libraryName, c.protocol(), m.QueueID),
+	}
+	if s := c.session.TLS; s != nil {
+		lines = append(lines, fmt.Sprintf(
+			"(version=%s cipher=%s)",
+			tls.VersionName(s.Version),
+			tls.CipherSuiteName(s.CipherSuite),
+		))
+	}
+	if len(m.To) == 1 {
+		lines = append(lines, fmt.Sprintf("for <%s>", m.To[0]))
+	}
+	lines[len(lines)-1] += ";"
+	lines = append(lines, m.ReceivedAt.Format(time.RFC1123Z))
+	return "Received: " + strings.Join(lines, "\r\n\t") + "\r\n"
+}
+
+// traceHeaders returns the headers prepended to the message, if any, with the
+// Received header first and the metadata headers last.
+func (c *Client) traceHeaders(m *Message) string {
+	var h string
+	if c.config.Received {
+		h += c.receivedHeader(m)
+	}
+	if len(c.config.StampHeader) != 0 {
+		h += c.stampHeader()
+	}
+	if len(c.config.MetadataPrefix) != 0 {
+		h += c.metadataHeaders()
+	}
+	return h
+}
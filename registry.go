@@ -0,0 +1,86 @@
+package smtpsrv
+
+import (
+	"sync"
+)
+
+// registry tracks the clients that are currently active. Clients are added
+// before their goroutine is started and removed when it exits, so a client
+// that finishes immediately can never be missed.
+type registry struct {
+	mutex     sync.Mutex
+	clients   map[*Client]bool
+	waitGroup sync.WaitGroup
+
+	// Signalled when a client finishes or the server stops accepting
+	// connections
+	cond    *sync.Cond
+	stopped bool
+}
+
+// init prepares the registry for use. The mutex must be held.
+func (r *registry) init() {
+	if r.clients == nil {
+		r.clients = map[*Client]bool{}
+		r.cond = sync.NewCond(&r.mutex)
+	}
+}
+
+// add registers a client as active.
+func (r *registry) add(c *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	r.clients[c] = true
+	r.waitGroup.Add(1)
+}
+
+// remove indicates that the client has finished.
+func (r *registry) remove(c *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.clients, c)
+	r.waitGroup.Done()
+	r.cond.Broadcast()
+}
+
+// count returns the number of active clients.
+func (r *registry) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.clients)
+}
+
+// waitBelow blocks until fewer than n clients are active or stop is called.
+func (r *registry) waitBelow(n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	for !r.stopped && len(r.clients) >= n {
+		r.cond.Wait()
+	}
+}
+
+// stop wakes any callers of waitBelow since no more clients will be
+// accepted.
+func (r *registry) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.init()
+	r.stopped = true
+	r.cond.Broadcast()
+}
+
+// wait blocks until all clients have finished.
+func (r *registry) wait() {
+	r.waitGroup.Wait()
+}
+
+// each invokes f for each active client.
+func (r *registry) each(f func(c *Client)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for c := range r.clients {
+		f(c)
+	}
+}
@@ -0,0 +1,53 @@
+package smtpsrv
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// trusted determines whether the address belongs to one of the networks.
+func trusted(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginIP determines the address of the client that originally submitted a
+// message received from the specified client. If the client is one of the
+// trusted relays, the Received headers it added are believed and the chain of
+// hops (from the most recent to the earliest, as in ParsedMessage.Received)
+// is followed until it reaches an address that is not trusted, which is
+// returned. Hops recorded by untrusted servers are never consulted since the
+// sender could have forged them.
+func OriginIP(client net.IP, hops []*Hop, relays []*net.IPNet) net.IP {
+	ip := client
+	for _, h := range hops {
+		if !trusted(ip, relays) || h.IP == nil {
+			break
+		}
+		ip = h.IP
+	}
+	return ip
+}
+
+// originIP determines the originating address of a message with the
+// specified content using TrustedRelays. Only the headers are parsed and
+// only if the client is itself a trusted relay.
+func (c *Client) originIP(body string) net.IP {
+	a, ok := c.session.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if !trusted(a.IP, c.config.TrustedRelays) {
+		return a.IP
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		return a.IP
+	}
+	return OriginIP(a.IP, parseReceivedChain(msg.Header), c.config.TrustedRelays)
+}
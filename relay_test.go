@@ -0,0 +1,33 @@
+package smtpsrv
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginIP(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	var (
+		relays = []*net.IPNet{n}
+		hops   = []*Hop{
+			{IP: net.ParseIP("10.0.0.2")},
+			{IP: net.ParseIP("192.0.2.1")},
+			{IP: net.ParseIP("198.51.100.1")},
+		}
+	)
+	for _, v := range []struct {
+		client string
+		hops   []*Hop
+		ip     string
+	}{
+		{"192.0.2.2", hops, "192.0.2.2"},
+		{"10.0.0.1", hops, "192.0.2.1"},
+		{"10.0.0.1", hops[:1], "10.0.0.2"},
+		{"10.0.0.1", nil, "10.0.0.1"},
+	} {
+		ip := OriginIP(net.ParseIP(v.client), v.hops, relays)
+		if !ip.Equal(net.ParseIP(v.ip)) {
+			t.Fatalf("%s != %s", ip, v.ip)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Reply codes defined in RFC 5321 section 4.2.3 and the extensions
+// implemented by this package.
+const (
+	CodeSystemStatus           = 211
+	CodeHelp                   = 214
+	CodeServiceReady           = 220
+	CodeServiceClosing         = 221
+	CodeAuthSucceeded          = 235
+	CodeOK                     = 250
+	CodeUserNotLocal           = 251
+	CodeCannotVerify           = 252
+	CodeAuthContinue           = 334
+	CodeStartMailInput         = 354
+	CodeServiceUnavailable     = 421
+	CodeMailboxBusy            = 450
+	CodeLocalError             = 451
+	CodeInsufficientStorage    = 452
+	CodeTempAuthFailure        = 454
+	CodeParamsNotAccommodated  = 455
+	CodeSyntaxError            = 500
+	CodeParamSyntaxError       = 501
+	CodeNotImplemented         = 502
+	CodeBadSequence            = 503
+	CodeParamNotImplemented    = 504
+	CodeAuthRequired           = 530
+	CodeAuthInvalid            = 535
+	CodeMailboxUnavailable     = 550
+	CodeUserNotLocalTryForward = 551
+	CodeExceededStorage        = 552
+	CodeMailboxNameNotAllowed  = 553
+	CodeTransactionFailed      = 554
+	CodeParamsNotRecognized    = 555
+)
+
+// Reply represents a reply to an SMTP command, consisting of the basic reply
+// code, an enhanced status code (RFC 3463) such as "2.0.0", and the text of
+// the reply. Enhanced may be empty. The message may contain newlines, in
+// which case a multi-line reply is sent.
+type Reply struct {
+	Code     int
+	Enhanced string
+	Message  string
+}
+
+// Temporary determines whether the reply indicates a transient failure.
+func (r Reply) Temporary() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+// Permanent determines whether the reply indicates a permanent failure.
+func (r Reply) Permanent() bool {
+	return r.Code >= 500
+}
+
+// String formats the reply as it would be sent to the client, without the
+// trailing CRLF. The enhanced status code is included on each line.
+func (r Reply) String() string {
+	var (
+		lines = strings.Split(r.Message, "\n")
+		b     bytes.Buffer
+	)
+	for i, l := range lines {
+		if i != 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(strconv.Itoa(r.Code))
+		if i < len(lines)-1 {
+			b.WriteString("-")
+		} else {
+			b.WriteString(" ")
+		}
+		if len(r.Enhanced) != 0 {
+			b.WriteString(r.Enhanced + " ")
+		}
+		b.WriteString(l)
+	}
+	return b.String()
+}
+
+// SMTPError is an error that can be returned by hooks and handlers to send a
+// specific reply to the client. The message may contain newlines, in which
+// case a multi-line reply is sent.
+type SMTPError struct {
+	Code     int
+	Enhanced string
+	Message  string
+}
+
+// Error returns the reply as it would be sent to the client.
+func (e SMTPError) Error() string {
+	return e.Reply().String()
+}
+
+// Reply converts the error to a reply.
+func (e SMTPError) Reply() Reply {
+	return Reply{e.Code, e.Enhanced, e.Message}
+}
+
+// replies contains the replies sent by the server, keyed by name. Any of them
+// may be overridden with Config.Replies. Messages containing a verb are
+// formatted with details of the failure, such as the name of a parameter.
+var replies = map[string]Reply{
+	"connect.rejected":    {CodeTransactionFailed, "5.7.1", "connection rejected"},
+	"connect.blocklisted": {CodeTransactionFailed, "5.7.1", "client listed by %s"},
+	"connect.too-many":    {CodeServiceUnavailable, "4.7.0", "too many connections"},
+	"connect.too-many-ip": {CodeServiceUnavailable, "4.7.0", "too many connections from your address"},
+	"command.unknown":     {CodeNotImplemented, "5.5.1", "unsupported command"},
+	"param.syntax":        {CodeParamSyntaxError, "5.5.4", "invalid parameter syntax"},
+	"param.unknown":       {CodeParamsNotRecognized, "5.5.4", "unrecognized parameter %s"},
+	"param.invalid":       {CodeParamSyntaxError, "5.5.4", "invalid %s parameter"},
+	"param.value":         {CodeParamSyntaxError, "5.5.4", "parameter does not take a value"},
+	"shutdown":            {CodeServiceUnavailable, "4.3.2", "service shutting down"},
+	"errors.too-many":     {CodeServiceUnavailable, "4.7.0", "too many errors"},
+	"commands.too-many":   {CodeServiceUnavailable, "4.7.0", "too many commands, slow down"},
+	"line.too-long":       {CodeSyntaxError, "5.5.2", "line too long"},
+	"line.bare-lf":        {CodeSyntaxError, "5.5.2", "bare LF received"},
+	"helo.missing":        {CodeParamSyntaxError, "5.5.4", "hostname required"},
+	"helo.literal":        {CodeParamSyntaxError, "5.5.4", "%s"},
+	"helo.rejected":       {CodeMailboxUnavailable, "5.7.1", "hostname rejected"},
+	"helo.first":          {CodeBadSequence, "5.5.1", "send %s first"},
+	"helo.required":       {CodeBadSequence, "5.5.1", "EHLO required after STARTTLS"},
+	"starttls.ready":      {CodeServiceReady, "2.0.0", "ready to start TLS"},
+	"starttls.active":     {CodeBadSequence, "5.5.1", "TLS already active"},
+	"auth.tls-required":   {CodeAuthRequired, "5.7.0", "must issue a STARTTLS command first"},
+	"auth.active":         {CodeBadSequence, "5.5.1", "already authenticated"},
+	"auth.in-transaction": {CodeBadSequence, "5.5.1", "AUTH not permitted during a mail transaction"},
+	"auth.syntax":         {CodeParamSyntaxError, "5.5.4", "syntax: \"AUTH mechanism [initial-response]\""},
+	"auth.mechanism":      {CodeParamNotImplemented, "5.5.4", "unrecognized authentication type"},
+	"auth.malformed":      {CodeParamSyntaxError, "5.5.2", "malformed authentication response"},
+	"auth.cancelled":      {CodeParamSyntaxError, "5.0.0", "authentication cancelled"},
+	"auth.invalid":        {CodeAuthInvalid, "5.7.8", "authentication credentials invalid"},
+	"auth.ok":             {CodeAuthSucceeded, "2.7.0", "authentication succeeded"},
+	"mail.auth-required":  {CodeAuthRequired, "5.7.0", "authentication required"},
+	"mail.active":         {CodeBadSequence, "5.5.1", "MAIL already invoked"},
+	"mail.blocklisted":    {CodeTransactionFailed, "5.7.1", "client listed by %s"},
+	"mail.too-many":       {CodeMailboxBusy, "4.7.0", "too many messages, try again later"},
+	"mail.syntax":         {CodeParamSyntaxError, "5.5.4", "syntax: \"MAIL FROM:<address>\""},
+	"mail.address":        {CodeParamSyntaxError, "5.1.7", "%s"},
+	"mail.too-large":      {CodeExceededStorage, "5.3.4", "message size exceeds fixed maximum message size"},
+	"mail.rejected":       {CodeMailboxUnavailable, "5.7.1", "sender rejected"},
+	"mail.tls-required":   {CodeAuthRequired, "5.7.10", "encryption required for mail from this domain"},
+	"mail.ok":             {CodeOK, "2.1.0", "ok"},
+	"rcpt.no-mail":        {CodeBadSequence, "5.5.1", "MAIL must be invoked first"},
+	"rcpt.syntax":         {CodeParamSyntaxError, "5.5.4", "syntax: \"RCPT TO:<address>\""},
+	"rcpt.address":        {CodeParamSyntaxError, "5.1.3", "%s"},
+	"rcpt.rejected":       {CodeMailboxUnavailable, "5.7.1", "recipient rejected"},
+	"rcpt.spf-fail":       {CodeMailboxUnavailable, "5.7.23", "SPF validation failed for %s"},
+	"rcpt.too-many":       {CodeInsufficientStorage, "4.5.3", "too many recipients"},
+	"rcpt.ok":             {CodeOK, "2.1.5", "ok"},
+	"smtputf8.required":   {CodeMailboxNameNotAllowed, "5.6.7", "SMTPUTF8 required for non-ASCII address"},
+	"data.no-rcpt":        {CodeBadSequence, "5.5.1", "RCPT must be invoked first"},
+	"data.after-bdat":     {CodeBadSequence, "5.5.1", "DATA not permitted after BDAT"},
+	"data.binarymime":     {CodeBadSequence, "5.5.1", "BINARYMIME requires BDAT"},
+	"data.rejected":       {CodeTransactionFailed, "5.7.1", "transaction rejected"},
+	"data.start":          {CodeStartMailInput, "", "continue until \\r\\n.\\r\\n"},
+	"data.too-large":      {CodeExceededStorage, "5.3.4", "message size exceeds fixed maximum message size"},
+	"data.line-too-long":  {CodeSyntaxError, "5.5.2", "line too long"},
+	"data.8bit-headers":   {CodeTransactionFailed, "5.6.0", "8-bit headers require SMTPUTF8"},
+	"data.dmarc":          {CodeMailboxUnavailable, "5.7.1", "rejected by DMARC policy for %s"},
+	"data.decode-limit":   {CodeTransactionFailed, "5.6.0", "decoded content exceeds %s limit"},
+	"data.timeout":        {CodeLocalError, "4.4.5", "message could not be queued in time"},
+	"data.failed":         {CodeLocalError, "4.3.0", "message could not be processed"},
+	"data.keepalive":      {CodeOK, "2.0.0", "processing"},
+	"data.queued":         {CodeOK, "2.0.0", "ok: queued as %s"},
+	"bdat.syntax":         {CodeParamSyntaxError, "5.5.4", "syntax: \"BDAT size [LAST]\""},
+	"bdat.size":           {CodeParamSyntaxError, "5.5.4", "invalid chunk size"},
+	"bdat.ok":             {CodeOK, "2.0.0", "chunk received"},
+	"vrfy.syntax":         {CodeParamSyntaxError, "5.5.4", "syntax: \"VRFY string\""},
+	"expn.syntax":         {CodeParamSyntaxError, "5.5.4", "syntax: \"EXPN string\""},
+	"help":                {CodeHelp, "2.0.0", "%s"},
+	"help.unknown":        {CodeParamNotImplemented, "5.5.1", "no help available for %s"},
+	"rset.ok":             {CodeOK, "2.0.0", "ok"},
+	"noop.ok":             {CodeOK, "2.0.0", "ok"},
+	"quit":                {CodeServiceClosing, "2.0.0", "bye"},
+}
+
+// pick returns the temporary or permanent variant of a reply.
+func pick(temp bool, tempReply, permReply Reply) Reply {
+	if temp {
+		return tempReply
+	}
+	return permReply
+}
+
+// ReplyOK indicates that the command completed successfully.
+func ReplyOK() Reply {
+	return Reply{CodeOK, "2.0.0", "ok"}
+}
+
+// ReplyCommandUnrecognized indicates that the command is not recognized.
+func ReplyCommandUnrecognized() Reply {
+	return Reply{CodeSyntaxError, "5.5.1", "command unrecognized"}
+}
+
+// ReplyCommandNotImplemented indicates that the command is not implemented,
+// which is the default reply to unknown commands.
+func ReplyCommandNotImplemented() Reply {
+	return Reply{CodeNotImplemented, "5.5.1", "unsupported command"}
+}
+
+// ReplyServiceUnavailable indicates that the server is closing the
+// connection.
+func ReplyServiceUnavailable() Reply {
+	return Reply{CodeServiceUnavailable, "4.3.2", "service not available, closing transmission channel"}
+}
+
+// ReplyCannotVerify indicates that the address cannot be verified but that
+// mail for it will be accepted.
+func ReplyCannotVerify() Reply {
+	return Reply{CodeCannotVerify, "2.5.0", "cannot VRFY user, but will accept message and attempt delivery"}
+}
+
+// ReplyLocalError indicates that the command failed due to a problem on the
+// server and may be retried later.
+func ReplyLocalError() Reply {
+	return Reply{CodeLocalError, "4.3.0", "local error in processing"}
+}
+
+// ReplyInsufficientStorage indicates that the server cannot currently store
+// the message.
+func ReplyInsufficientStorage() Reply {
+	return Reply{CodeInsufficientStorage, "4.3.1", "insufficient system storage"}
+}
+
+// ReplyMailboxUnavailable indicates that the mailbox does not exist or
+// cannot currently receive mail.
+func ReplyMailboxUnavailable(temp bool) Reply {
+	return pick(
+		temp,
+		Reply{CodeMailboxBusy, "4.2.1", "mailbox temporarily unavailable"},
+		Reply{CodeMailboxUnavailable, "5.1.1", "mailbox unavailable"},
+	)
+}
+
+// ReplyMailboxFull indicates that the mailbox has exceeded its storage
+// allocation.
+func ReplyMailboxFull(temp bool) Reply {
+	return pick(
+		temp,
+		Reply{CodeInsufficientStorage, "4.2.2", "mailbox full"},
+		Reply{CodeExceededStorage, "5.2.2", "mailbox full"},
+	)
+}
+
+// ReplyBadSender indicates that the sender address is not acceptable.
+func ReplyBadSender(temp bool) Reply {
+	return pick(
+		temp,
+		Reply{CodeMailboxBusy, "4.1.8", "sender address temporarily rejected"},
+		Reply{CodeMailboxUnavailable, "5.1.8", "sender address rejected"},
+	)
+}
+
+// ReplyPolicyRejection indicates that the transaction was refused due to
+// local policy.
+func ReplyPolicyRejection(temp bool) Reply {
+	return pick(
+		temp,
+		Reply{CodeMailboxBusy, "4.7.1", "temporarily rejected by policy"},
+		Reply{CodeMailboxUnavailable, "5.7.1", "rejected by policy"},
+	)
+}
+
+// ReplyTransactionFailed indicates that the transaction failed for a reason
+// not covered by a more specific reply.
+func ReplyTransactionFailed(temp bool) Reply {
+	return pick(
+		temp,
+		Reply{CodeLocalError, "4.0.0", "transaction failed"},
+		Reply{CodeTransactionFailed, "5.0.0", "transaction failed"},
+	)
+}
+
+// ReplyTooManyRecipients indicates that no more recipients will be accepted
+// for the current transaction.
+func ReplyTooManyRecipients() Reply {
+	return Reply{CodeInsufficientStorage, "4.5.3", "too many recipients"}
+}
+
+// ReplyMessageTooBig indicates that the message exceeds the maximum size.
+func ReplyMessageTooBig() Reply {
+	return Reply{CodeExceededStorage, "5.3.4", "message size exceeds fixed maximum message size"}
+}
+
+// ReplySyntaxError indicates that the command or its parameters could not be
+// parsed.
+func ReplySyntaxError() Reply {
+	return Reply{CodeParamSyntaxError, "5.5.4", "syntax error in parameters or arguments"}
+}
+
+// ReplyBadSequence indicates that the command was issued out of order.
+func ReplyBadSequence() Reply {
+	return Reply{CodeBadSequence, "5.5.1", "bad sequence of commands"}
+}
+
+// ReplyAuthRequired indicates that the client must authenticate first.
+func ReplyAuthRequired() Reply {
+	return Reply{CodeAuthRequired, "5.7.0", "authentication required"}
+}
@@ -0,0 +1,49 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestReplyHelpers(t *testing.T) {
+	for _, r := range []Reply{
+		ReplyOK(),
+		ReplyServiceUnavailable(),
+		ReplyLocalError(),
+		ReplyInsufficientStorage(),
+		ReplyMailboxUnavailable(true),
+		ReplyMailboxUnavailable(false),
+		ReplyMailboxFull(true),
+		ReplyMailboxFull(false),
+		ReplyBadSender(true),
+		ReplyBadSender(false),
+		ReplyPolicyRejection(true),
+		ReplyPolicyRejection(false),
+		ReplyTransactionFailed(true),
+		ReplyTransactionFailed(false),
+		ReplyTooManyRecipients(),
+		ReplyMessageTooBig(),
+		ReplySyntaxError(),
+		ReplyBadSequence(),
+		ReplyAuthRequired(),
+	} {
+		// The class of the enhanced code must match the basic code
+		if r.Enhanced[0] != byte('0'+r.Code/100) {
+			t.Fatalf("%d does not match %s", r.Code, r.Enhanced)
+		}
+	}
+}
+
+func TestReplyTable(t *testing.T) {
+	for name, r := range replies {
+		if len(r.Enhanced) != 0 && r.Enhanced[0] != byte('0'+r.Code/100) {
+			t.Fatalf("%s: %d does not match %s", name, r.Code, r.Enhanced)
+		}
+	}
+}
+
+func TestReplyString(t *testing.T) {
+	r := Reply{CodeOK, "2.0.0", "first\nsecond"}
+	if s := r.String(); s != "250-2.0.0 first\r\n250 2.0.0 second" {
+		t.Fatalf("unexpected reply %q", s)
+	}
+}
@@ -0,0 +1,81 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Security describes the signature or encryption applied to a message with
+// S/MIME (RFC 8551) or PGP/MIME (RFC 3156).
+type Security struct {
+	// "S/MIME" or "PGP/MIME"
+	Format    string
+	Signed    bool
+	Encrypted bool
+	// For multipart/signed messages, the part that was signed (exactly as it
+	// appeared in the message, including its headers) and the decoded
+	// signature, which can be verified using an S/MIME or OpenPGP library
+	SignedData []byte
+	Signature  []byte
+	// Hash algorithm used for the signature (micalg parameter)
+	Micalg string
+}
+
+// detectSecurity determines whether the message is signed or encrypted by
+// examining the top-level part. Nil is returned if it is neither.
+func detectSecurity(root *Part, raw []byte) *Security {
+	switch root.ContentType {
+	case "multipart/signed":
+		s := &Security{
+			Signed: true,
+			Micalg: strings.ToLower(root.Params["micalg"]),
+		}
+		switch strings.ToLower(root.Params["protocol"]) {
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			s.Format = "S/MIME"
+		case "application/pgp-signature":
+			s.Format = "PGP/MIME"
+		default:
+			return nil
+		}
+		if len(root.Parts) == 2 {
+			s.SignedData = signedData(raw, root.Params["boundary"])
+			s.Signature = root.Parts[1].Content
+		}
+		return s
+	case "multipart/encrypted":
+		if strings.ToLower(root.Params["protocol"]) == "application/pgp-encrypted" {
+			return &Security{Format: "PGP/MIME", Encrypted: true}
+		}
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		s := &Security{Format: "S/MIME"}
+		switch strings.ToLower(root.Params["smime-type"]) {
+		case "signed-data":
+			s.Signed = true
+		case "enveloped-data", "authenveloped-data":
+			s.Encrypted = true
+		default:
+			return nil
+		}
+		return s
+	}
+	return nil
+}
+
+// signedData extracts the first part of a multipart/signed body without any
+// modification, since the signature covers the exact bytes that were sent
+// (RFC 1847 section 2.1). The CRLF preceding the next boundary belongs to the
+// boundary and is excluded.
+func signedData(raw []byte, boundary string) []byte {
+	delim := []byte("--" + boundary + "\r\n")
+	i := bytes.Index(raw, delim)
+	if i == -1 {
+		return nil
+	}
+	raw = raw[i+len(delim):]
+	j := bytes.Index(raw, []byte("\r\n--"+boundary))
+	if j == -1 {
+		return nil
+	}
+	return raw[:j]
+}
@@ -0,0 +1,73 @@
+package smtpsrv
+
+import (
+	"testing"
+)
+
+func TestDetectSecurity(t *testing.T) {
+	signed := "Content-Type: text/plain\r\n\r\n" + content
+	for _, v := range []struct {
+		body      string
+		format    string
+		signed    bool
+		encrypted bool
+	}{
+		{
+			"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\r\n" +
+				"\tmicalg=sha-256; boundary=\"b\"\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				signed + "\r\n" +
+				"--b\r\n" +
+				"Content-Type: application/pkcs7-signature\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"c2lnbmF0dXJl\r\n" +
+				"--b--\r\n",
+			"S/MIME", true, false,
+		},
+		{
+			"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"b\"\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"Content-Type: application/pgp-encrypted\r\n" +
+				"\r\n" +
+				"Version: 1\r\n" +
+				"--b--\r\n",
+			"PGP/MIME", false, true,
+		},
+		{
+			"Content-Type: application/pkcs7-mime; smime-type=enveloped-data\r\n" +
+				"\r\n" +
+				"ZW5jcnlwdGVk\r\n",
+			"S/MIME", false, true,
+		},
+		{
+			"Content-Type: text/plain\r\n\r\n" + content,
+			"", false, false,
+		},
+	} {
+		p, err := (&Message{Body: v.body}).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v.format) == 0 {
+			if p.Security != nil {
+				t.Fatalf("unexpected security %+v", p.Security)
+			}
+			continue
+		}
+		s := p.Security
+		if s == nil || s.Format != v.format || s.Signed != v.signed || s.Encrypted != v.encrypted {
+			t.Fatalf("unexpected security %+v", s)
+		}
+		if s.Signed {
+			if string(s.SignedData) != signed {
+				t.Fatalf("%q != %q", s.SignedData, signed)
+			}
+			if string(s.Signature) != "signature" || s.Micalg != "sha-256" {
+				t.Fatalf("unexpected signature %+v", s)
+			}
+		}
+	}
+}
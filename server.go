@@ -1,99 +1,230 @@
 package smtpsrv
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync"
 )
 
+var (
+	// ErrServerClosed is returned by Serve and the ListenAndServe methods once
+	// the server has been shut down.
+	ErrServerClosed = errors.New("server closed")
+
+	errNoTLSConfig = errors.New("TLSConfig is required for implicit TLS")
+)
+
 // Server accepts incoming SMTP connections and hands them off to Client
 // instances for processing.
 type Server struct {
 	// Receives new messages from clients
 	NewMessage <-chan *Message
 	newMessage chan *Message
-	finished   chan bool
 	config     *Config
-	listener   net.Listener
-
-	// Used for synchronizing shutdown - unfortunately, this is all necessary;
-	// the list monitors which clients are active so that shutdown can be
-	// performed upon request and the mutex guards access to the list
-	waitGroup      sync.WaitGroup
-	mutex          sync.Mutex
-	clients        []*Client
-	clientFinished chan *Client
+	sequence   uint64
+
+	// Listeners being served, the address of the first of them, and whether
+	// they have been closed (by Drain or shutdown) - serving is used to wait
+	// for Serve to return
+	mutex     sync.Mutex
+	listeners map[net.Listener]*Listener
+	addr      net.Addr
+	closed    bool
+	draining  bool
+	serving   sync.WaitGroup
+	stopped   chan struct{}
+
+	// Clients waiting for a worker if Config.Workers is set
+	queue chan *Client
+
+	// Ensure that the channels are only closed once, since Close and
+	// Shutdown may both be called (or either one more than once)
+	workersStopped sync.Once
+	finished       sync.Once
+
+	// Active clients are tracked so that shutdown can wait for them to
+	// finish - cancelling the context disconnects them - and are counted by
+	// address to enforce MaxConnectionsPerIP
+	ctx         context.Context
+	cancel      context.CancelFunc
+	registry    registry
+	connections connections
 }
 
-// accept listens for new connections from clients. When one connects, a new
-// Client instance is created, it is added to the list, and the wait group is
-// incremented.
-func (s *Server) accept() {
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			break
-		} else {
-			c := NewClient(s.config, s.newMessage, s.clientFinished, conn)
-			s.waitGroup.Add(1)
-			s.mutex.Lock()
-			s.clients = append(s.clients, c)
-			s.mutex.Unlock()
-		}
+// New creates a new server with the specified configuration. The server does
+// not accept connections until Serve or one of the ListenAndServe methods is
+// called.
+func New(config *Config) *Server {
+	var (
+		newMessage  = make(chan *Message)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	s := &Server{
+		NewMessage: newMessage,
+		newMessage: newMessage,
+		config:     config,
+		listeners:  map[net.Listener]*Listener{},
+		stopped:    make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
-	s.finished <- true
+	s.startWorkers()
+	return s
 }
 
-// remove watches for clients that have signalled that they are done and
-// removes them from the list of active clients. The wait group is also
-// decremented.
-func (s *Server) remove() {
-	for p := range s.clientFinished {
-		s.mutex.Lock()
-		for i, v := range s.clients {
-			if v == p {
-				s.clients = append(s.clients[:i], s.clients[i+1:]...)
-				s.waitGroup.Done()
-				break
+// NewServer creates a new server with the specified configuration and begins
+// accepting connections on Addr and each of Listeners.
+func NewServer(config *Config) (*Server, error) {
+	var (
+		s         = New(config)
+		listeners = append([]*Listener{{Addr: config.Addr}}, config.Listeners...)
+		ls        []net.Listener
+	)
+	for _, li := range listeners {
+		l, err := s.listen(li)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
 			}
+			return nil, err
 		}
-		s.mutex.Unlock()
+		ls = append(ls, l)
 	}
+	for i, l := range ls {
+		s.track(l, listeners[i])
+		go s.serve(l, listeners[i])
+	}
+	return s, nil
 }
 
-// NewServer creates a new server with the specified configuration.
-func NewServer(config *Config) (*Server, error) {
-	l, err := net.Listen("tcp", config.Addr)
+// track adds the listener to those closed when the server is shut down. False
+// is returned if the server has already been shut down.
+func (s *Server) track(l net.Listener, li *Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = li
+	if s.addr == nil {
+		s.addr = l.Addr()
+	}
+	s.serving.Add(1)
+	return true
+}
+
+// closeListeners stops the server from accepting new connections.
+func (s *Server) closeListeners() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		close(s.stopped)
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.registry.stop()
+}
+
+// Serve accepts connections on the listener, creating a new Client instance
+// for each of them, until the listener fails or the server is shut down.
+// Serve may be called more than once to accept connections on several
+// listeners. ErrServerClosed is returned once the server is shut down.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		l.Close()
+		return ErrServerClosed
+	}
+	return s.serve(l, nil)
+}
+
+// Addr returns the address of the first listener the server accepted
+// connections on, which for NewServer is the one on Config.Addr. This is
+// useful when the port is chosen by the system (as with ":0"). Nil is
+// returned if the server has not begun accepting connections.
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.addr
+}
+
+// ListenAndServe listens on Addr and accepts connections on it.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.config.Addr)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var (
-		newMessage = make(chan *Message)
-		s          = &Server{
-			NewMessage:     newMessage,
-			newMessage:     newMessage,
-			finished:       make(chan bool),
-			config:         config,
-			listener:       l,
-			clientFinished: make(chan *Client),
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on Addr and accepts connections that use
+// implicit TLS (RFC 8314) with TLSConfig. STARTTLS is not advertised to these
+// clients since the connection is already encrypted.
+func (s *Server) ListenAndServeTLS() error {
+	l, err := s.listen(&Listener{Addr: s.config.Addr, ImplicitTLS: true})
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// serve listens for new connections from clients. When one connects, a new
+// Client instance is created using the listener's configuration and
+// registered before it begins running.
+func (s *Server) serve(l net.Listener, li *Listener) error {
+	defer s.serving.Done()
+	config := s.listenerConfig(li)
+	for {
+		// Leave connections in the listen queue while at the limit
+		if config.MaxConnections != 0 && config.QueueConnections {
+			s.registry.waitBelow(config.MaxConnections)
 		}
-	)
-	go s.accept()
-	go s.remove()
-	return s, nil
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mutex.Lock()
+		c := newClient(config, s.newMessage, conn)
+		if li != nil {
+			c.session.Listener = li.Name
+		}
+		c.sequence = s.sequence
+		c.connections = &s.connections
+		c.tooMany = config.MaxConnections != 0 &&
+			s.registry.count() >= config.MaxConnections
+		s.sequence++
+		s.registry.add(c)
+		s.mutex.Unlock()
+		s.dispatch(c)
+	}
 }
 
 // Close shuts down the server and waits for all clients to disconnect. If
 // the force parameter is true, clients will be immediately disconnected.
 func (s *Server) Close(force bool) {
-	s.listener.Close()
-	<-s.finished
+	s.closeListeners()
+	s.serving.Wait()
+	s.stopWorkers()
 	if force {
-		s.mutex.Lock()
-		for _, v := range s.clients {
-			v.Close()
-		}
-		s.mutex.Unlock()
+		s.cancel()
 	}
-	s.waitGroup.Wait()
-	close(s.newMessage)
+	s.registry.wait()
+	s.finish()
+}
+
+// finish releases the server's context and closes NewMessage. The clients
+// must have disconnected, since they may still send messages on it.
+func (s *Server) finish() {
+	s.cancel()
+	s.finished.Do(func() {
+		close(s.newMessage)
+	})
 }
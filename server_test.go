@@ -1,11 +1,29 @@
 package smtpsrv
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,13 +39,53 @@ var (
 			testEmail2,
 			testEmail3,
 		},
-		Body: content,
+		Recipients: []*Recipient{
+			{Address: testEmail2},
+			{Address: testEmail3},
+		},
+		Params: map[string]string{
+			"BODY":     "8BITMIME",
+			"SMTPUTF8": "",
+		},
+		Body:     content,
+		Raw:      []byte(content + "\r\n"),
+		Helo:     "localhost",
+		Size:     int64(len(content)),
+		Checksum: sha256.Sum256([]byte(content)),
 	}
 )
 
+// captureMessage receives the first message from the server. The result is
+// available once the server has been closed and is nil if no message was
+// received.
+func captureMessage(s *Server) <-chan *Message {
+	c := make(chan *Message, 1)
+	go func() {
+		c <- <-s.NewMessage
+	}()
+	return c
+}
+
+// testCommand is a line sent to the server along with the expected reply code.
+type testCommand struct {
+	line string
+	code int
+}
+
+// testCommands sends each of the commands to the server and checks the reply.
+func testCommands(t *testing.T, c *textproto.Conn, commands []testCommand) {
+	for _, v := range commands {
+		if err := c.PrintfLine("%s", v.line); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.ReadResponse(v.code); err != nil {
+			t.Fatal(fmt.Errorf("%s: %s", v.line, err))
+		}
+	}
+}
+
 func TestResponse(t *testing.T) {
 	var (
-		m      *Message
 		s, err = NewServer(&Config{
 			Addr: "127.0.0.1:0",
 		})
@@ -36,11 +94,9 @@ func TestResponse(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Spawn a goroutine to capture any new message
-	go func() {
-		m = <-s.NewMessage
-	}()
+	messages := captureMessage(s)
 	// Connect to the server using its address
-	c, err := smtp.Dial(s.listener.Addr().String())
+	c, err := smtp.Dial(s.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +109,7 @@ func TestResponse(t *testing.T) {
 		t.Fatal(errors.New("RCPT should not have succeeded"))
 	}
 	// Make a correct call to MAIL but with an invalid address
-	if err := c.Mail(""); err == nil {
+	if err := c.Mail("invalid"); err == nil {
 		t.Fatal(errors.New("MAIL should not have accepted malformed address"))
 	}
 	// Now issue a legit email
@@ -97,38 +153,3122 @@ func TestResponse(t *testing.T) {
 	}
 	// Shut 'er down
 	s.Close(false)
+	m := <-messages
 	// Ensure a message was received
 	if m == nil {
 		t.Fatal(errors.New("message expected"))
 	}
+	// The session varies between connections, so it is checked separately
+	if m.Session == nil || m.Session.Helo != "localhost" || len(m.Session.ID) == 0 {
+		t.Fatal(fmt.Errorf("unexpected session %+v", m.Session))
+	}
+	if m.RemoteAddr == nil || m.ReceivedAt.IsZero() || len(m.QueueID) == 0 || m.TLSVersion != 0 {
+		t.Fatal(fmt.Errorf("unexpected metadata %v %v %q %d", m.RemoteAddr, m.ReceivedAt, m.QueueID, m.TLSVersion))
+	}
+	m.Session = nil
+	m.RemoteAddr = nil
+	m.ReceivedAt = time.Time{}
+	m.QueueID = ""
 	// Ensure it matches
 	if !reflect.DeepEqual(m, message) {
-		t.Fatal(fmt.Errorf("%t != %t", m, message))
+		t.Fatal(fmt.Errorf("%v != %v", m, message))
 	}
 }
 
-func TestTimeout(t *testing.T) {
+func TestJournal(t *testing.T) {
+	var (
+		b      bytes.Buffer
+		s, err = NewServer(&Config{
+			Addr:        "127.0.0.1:0",
+			Journal:     &b,
+			Received:    true,
+			StampHeader: "X-Test",
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	if err := smtp.SendMail(
+		s.Addr().String(),
+		nil,
+		testEmail1,
+		[]string{testEmail2},
+		[]byte(content),
+	); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	<-messages
+	var e journalEntry
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.From != testEmail1 || len(e.To) != 1 || e.Size != int64(len(content)) || e.Result != "queued" || len(e.QueueID) == 0 {
+		t.Fatal(fmt.Errorf("unexpected entry %+v", e))
+	}
+	if e.Disposition != string(DispositionAccepted) {
+		t.Fatalf("%s != %s", e.Disposition, DispositionAccepted)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		messages = make(chan *Message, 3)
+		s, err   = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			Handler: HandlerFunc(func(ctx context.Context, m *Message) error {
+				messages <- m
+				if strings.Contains(m.Body, "reject") {
+					return errors.New("rejected")
+				}
+				if strings.Contains(m.Body, "custom") {
+					return &SMTPError{CodeTransactionFailed, "5.7.1", "message\nrejected"}
+				}
+				return nil
+			}),
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+	})
+	for _, v := range []struct {
+		body string
+		code int
+	}{
+		{content, 250},
+		{"reject", 451},
+		{"custom", 554},
+	} {
+		testCommands(t, c, []testCommand{
+			{"MAIL FROM:<" + testEmail1 + ">", 250},
+			{"RCPT TO:<" + testEmail2 + ">", 250},
+			{"DATA", 354},
+			{v.body + "\r\n.", v.code},
+		})
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	s.Close(false)
+	if len(messages) != 3 {
+		t.Fatal(errors.New("handler should have been invoked three times"))
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var (
+		errRejected = errors.New("rejected")
+		s, err      = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			OnHelo: func(c *Client, hostname string) error {
+				if hostname == "bad" {
+					return errRejected
+				}
+				return nil
+			},
+			OnMail: func(c *Client, from string, params map[string]string) error {
+				if from == testEmail2 {
+					return errRejected
+				}
+				return nil
+			},
+			OnRcpt: func(c *Client, to string, params map[string]string) error {
+				if to == testEmail3 {
+					return SMTPError{CodeMailboxUnavailable, "5.1.1", "no such user"}
+				}
+				return nil
+			},
+			OnData: func(c *Client) error {
+				return errRejected
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO bad", 550},
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail2 + ">", 550},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+	})
+	if err := c.PrintfLine("RCPT TO:<%s>", testEmail3); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadResponse(550); err != nil || msg != "5.1.1 no such user" {
+		t.Fatal(fmt.Errorf("unexpected reply %q (%v)", msg, err))
+	}
+	testCommands(t, c, []testCommand{
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 554},
+		{"QUIT", 221},
+	})
+	s.Close(false)
+	s, err = NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		OnConnect: func(c *Client) error {
+			return errRejected
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = textproto.Dial("tcp", s.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(554); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal(errors.New("client should have been disconnected"))
+	}
+	s.Close(false)
+}
+
+// streamHandler records the content of each message it receives.
+type streamHandler struct {
+	bodies chan string
+}
+
+func (h *streamHandler) ServeSMTP(ctx context.Context, m *Message) error {
+	return errors.New("ServeSMTPStream should have been used")
+}
+
+func (h *streamHandler) ServeSMTPStream(ctx context.Context, m *Message, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	h.bodies <- string(b)
+	return nil
+}
+
+// stalledStreamHandler never reads the message or returns.
+type stalledStreamHandler struct {
+	block chan struct{}
+}
+
+func (h *stalledStreamHandler) ServeSMTP(ctx context.Context, m *Message) error {
+	return errors.New("ServeSMTPStream should have been used")
+}
+
+func (h *stalledStreamHandler) ServeSMTPStream(ctx context.Context, m *Message, r io.Reader) error {
+	<-h.block
+	return nil
+}
+
+func TestStreamHandlerTimeout(t *testing.T) {
+	var (
+		b      bytes.Buffer
+		h      = &stalledStreamHandler{block: make(chan struct{})}
+		s, err = NewServer(&Config{
+			Addr:           "127.0.0.1:0",
+			MessageTimeout: 50 * time.Millisecond,
+			Handler:        h,
+			Journal:        &b,
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(h.block)
+	err = smtp.SendMail(s.Addr().String(), nil, testEmail1, []string{testEmail2}, []byte(content))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 451 || !strings.Contains(e.Msg, "4.4.5") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s.Close(false)
+	var e journalEntry
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Result != "timeout" || e.Size != int64(len(content)) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	var (
+		h       = &streamHandler{bodies: make(chan string, 2)}
+		journal bytes.Buffer
+		s, err  = NewServer(&Config{
+			Addr:           "127.0.0.1:0",
+			MaxMessageSize: 100,
+			Handler:        h,
+			Journal:        &journal,
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+	})
+	for _, v := range []struct {
+		body string
+		code int
+	}{
+		{"..stuffed\r\n" + content, 250},
+		{strings.Repeat("x", 101), 552},
+	} {
+		testCommands(t, c, []testCommand{
+			{"MAIL FROM:<" + testEmail1 + ">", 250},
+			{"RCPT TO:<" + testEmail2 + ">", 250},
+			{"DATA", 354},
+			{v.body + "\r\n.", v.code},
+		})
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	s.Close(false)
+	if len(h.bodies) != 1 {
+		t.Fatal(errors.New("one message should have been received"))
+	}
+	if b := <-h.bodies; b != ".stuffed\r\n"+content+"\r\n" {
+		t.Fatal(fmt.Errorf("unexpected body %q", b))
+	}
+	// The size and checksum of the content are journaled even though the
+	// handler never saw them
+	var (
+		body     = ".stuffed\r\n" + content
+		checksum = sha256.Sum256([]byte(body))
+		e        journalEntry
+	)
+	if err := json.NewDecoder(&journal).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != int64(len(body)) || e.Checksum != hex.EncodeToString(checksum[:]) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
 	s, err := NewServer(&Config{
-		Addr:        "127.0.0.1:0",
-		ReadTimeout: 50 * time.Millisecond,
+		Addr:      "127.0.0.1:0",
+		KeepAlive: 20 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx context.Context, m *Message) error {
+			time.Sleep(100 * time.Millisecond)
+			if strings.Contains(m.Body, "fail") {
+				return errors.New("failed")
+			}
+			return nil
+		}),
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Connect to the server using its address
-	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	c, err := textproto.Dial("tcp", s.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
-	c, err := smtp.NewClient(conn, "localhost")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+	})
+	for _, body := range []string{content, "fail"} {
+		testCommands(t, c, []testCommand{
+			{"MAIL FROM:<" + testEmail1 + ">", 250},
+			{"RCPT TO:<" + testEmail2 + ">", 250},
+			{"DATA", 354},
+		})
+		if err := c.PrintfLine("%s\r\n.", body); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := c.ReadResponse(250)
+		if body == content {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(msg, "2.0.0 processing\n") {
+				t.Fatal(fmt.Errorf("keepalives expected in %q", msg))
+			}
+		} else if err == nil {
+			t.Fatal(errors.New("client should have been disconnected"))
+		}
+	}
+	s.Close(false)
+}
+
+func TestDotStuffing(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Hang for 100ms to trigger the timeout
-	time.Sleep(100 * time.Millisecond)
-	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
-	if err := c.Hello("localhost"); err == nil {
-		t.Fatal(errors.New("timeout expected"))
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+		{"..leading\r\n..\r\n\r\n.", 250},
+		{"QUIT", 221},
+	})
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.Body != ".leading\r\n.\r\n" || string(m.Raw) != ".leading\r\n.\r\n\r\n" {
+		t.Fatal(fmt.Errorf("unexpected content %q %q", m.Body, m.Raw))
+	}
+}
+
+func TestSessionValues(t *testing.T) {
+	type key string
+	var (
+		mailKey = key("mail")
+		s, err  = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			OnMail: func(c *Client, from string, params map[string]string) error {
+				c.Session().Values[mailKey] = from
+				return nil
+			},
+			OnRcpt: func(c *Client, to string, params map[string]string) error {
+				if c.Session().Values[mailKey] != testEmail1 {
+					return errors.New("value not shared")
+				}
+				return nil
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	if err := smtp.SendMail(
+		s.Addr().String(),
+		nil,
+		testEmail1,
+		[]string{testEmail2},
+		[]byte(content),
+	); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	if m := <-messages; m == nil || m.Session.Values[mailKey] != testEmail1 {
+		t.Fatal(errors.New("value should have been attached to the message"))
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr:        "127.0.0.1:0",
+			Banner:      "test",
+			Identify:    true,
+			StampHeader: "X-Received-By",
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	} else if msg != "test [go-smtpsrv]" {
+		t.Fatal(fmt.Errorf("unexpected banner %s", msg))
 	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+		{content + "\r\n.", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if b := "X-Received-By: go-smtpsrv\r\n" + content; m.Body != b {
+		t.Fatal(fmt.Errorf("%q != %q", m.Body, b))
+	}
+}
+
+func TestReceived(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr:        "127.0.0.1:0",
+			Banner:      "mx.example.com",
+			StampHeader: "X-Received-By",
+			Received:    true,
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	if err := c.PrintfLine("%s\r\n.", content); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	c.Close()
 	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	// The queue ID is reported to the client so that logs can be correlated
+	if q := "2.0.0 ok: queued as " + m.QueueID; msg != q {
+		t.Fatal(fmt.Errorf("%q != %q", msg, q))
+	}
+	b := fmt.Sprintf(
+		"Received: from client.example.com ([127.0.0.1])\r\n"+
+			"\tby mx.example.com (go-smtpsrv) with ESMTP id %s\r\n"+
+			"\tfor <%s>;\r\n"+
+			"\t%s\r\n"+
+			"X-Received-By: go-smtpsrv\r\n%s",
+		m.QueueID,
+		testEmail2,
+		m.ReceivedAt.Format(time.RFC1123Z),
+		content,
+	)
+	if m.Body != b {
+		t.Fatal(fmt.Errorf("%q != %q", m.Body, b))
+	}
+}
+
+// closeWithin closes the server and fails if it does not shut down in time.
+func closeWithin(t *testing.T, s *Server, force bool, d time.Duration) {
+	done := make(chan bool)
+	go func() {
+		s.Close(force)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal(errors.New("server did not shut down"))
+	}
+}
+
+func TestCloseRace(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clients that disconnect immediately must still be accounted for
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	closeWithin(t, s, false, 5*time.Second)
+}
+
+func TestCloseForce(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One client is idle and the other is waiting for its message to be
+	// received (which never happens)
+	idle, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testCommands(t, c.Text, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	if err := c.Text.PrintfLine("%s\r\n.", content); err != nil {
+		t.Fatal(err)
+	}
+	closeWithin(t, s, true, 5*time.Second)
+	if s.registry.count() != 0 {
+		t.Fatal(errors.New("clients should have been removed"))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:        "127.0.0.1:0",
+		ReadTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connect to the server using its address
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hang for 100ms to trigger the timeout
+	time.Sleep(100 * time.Millisecond)
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := c.Hello("localhost"); err == nil {
+		t.Fatal(errors.New("timeout expected"))
+	}
+	s.Close(false)
+}
+
+func TestDataStartTimeout(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:             "127.0.0.1:0",
+		DataStartTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	// The client is disconnected if it does not begin sending content
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal(errors.New("client should have been disconnected"))
+	}
+	c.Close()
+	s.Close(false)
+}
+
+func TestPace(t *testing.T) {
+	var (
+		delay  = 50 * time.Millisecond
+		calls  int
+		s, err = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			// The banner and first command are delayed briefly and the
+			// second command indefinitely
+			Pace: func(c *Client) time.Duration {
+				calls++
+				if calls > 2 {
+					return time.Hour
+				}
+				return delay
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"NOOP", 250},
+	})
+	if d := time.Since(start); d < 2*delay {
+		t.Fatal(fmt.Errorf("replies were not delayed (%s)", d))
+	}
+	// Shutting down must not wait for the delay
+	if err := c.PrintfLine("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+	closeWithin(t, s, true, time.Second)
+}
+
+func TestMessageTimeout(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:           "127.0.0.1:0",
+		MessageTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is receiving from NewMessage, so the message must be refused
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content))
+	if err := w.Close(); err == nil {
+		t.Fatal(errors.New("DATA should not have succeeded"))
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:           "127.0.0.1:0",
+		MaxMessageSize: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, p := c.Extension("SIZE"); !ok || p != fmt.Sprintf("%d", len(content)) {
+		t.Fatal(errors.New("SIZE should have been advertised with the limit"))
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		t.Fatal(err)
+	}
+	// The content plus a single byte exceeds the limit
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content + "!"))
+	if err := w.Close(); err == nil {
+		t.Fatal(errors.New("DATA should not have succeeded"))
+	}
+	// A declared size that exceeds the limit must be refused up front
+	testCommands(t, c.Text, []testCommand{
+		{fmt.Sprintf("MAIL FROM:<%s> SIZE=%d", testEmail1, len(content)+1), 552},
+	})
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+}
+
+func TestMaxRecipients(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:          "127.0.0.1:0",
+		MaxRecipients: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"RCPT TO:<" + testEmail3 + ">", 452},
+		{"RSET", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail3 + ">", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+func TestLineLength(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// Lines longer than the buffer are discarded in their entirety
+	testCommands(t, c, []testCommand{
+		{"NOOP " + strings.Repeat("x", 505), 250},
+		{"NOOP " + strings.Repeat("x", 506), 500},
+		{"NOOP " + strings.Repeat("x", 10000), 500},
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+		{strings.Repeat("x", 999) + "\r\n.", 500},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+func TestMaxErrors(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:      "127.0.0.1:0",
+		MaxErrors: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// A successful command resets the count
+	testCommands(t, c, []testCommand{
+		{"BOGUS", 502},
+		{"RCPT TO:<" + testEmail1 + ">", 503},
+		{"NOOP", 250},
+		{"BOGUS", 502},
+		{"BOGUS", 502},
+		{"BOGUS", 502},
+	})
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal(errors.New("client should have been disconnected"))
+	}
+	c.Close()
+	s.Close(false)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var (
+		params = make(chan string, 1)
+		s, err = NewServer(&Config{
+			Addr:      "127.0.0.1:0",
+			MaxErrors: 2,
+			UnknownCommand: func(c *Client, command, param string) Reply {
+				if command == "XFOO" {
+					params <- param
+					return ReplyOK()
+				}
+				return ReplyCommandUnrecognized()
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"xfoo bar", 250},
+		{"BOGUS", 500},
+		{"BOGUS", 500},
+	})
+	if p := <-params; p != "bar" {
+		t.Fatal(fmt.Errorf("unexpected parameter %s", p))
+	}
+	// Unknown commands count toward the error budget
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.Close(false)
+}
+
+func TestExtensions(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:           "127.0.0.1:0",
+		MaxMessageSize: 1000,
+		Authenticator: func(mechanism, username, password string) error {
+			return nil
+		},
+		Extensions: func(c *Client, extensions []string) []string {
+			// Hide AUTH and advertise an additional extension
+			e := []string{"X-TEST"}
+			for _, v := range extensions {
+				if !strings.HasPrefix(v, "AUTH") {
+					e = append(e, v)
+				}
+			}
+			return e
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		extension  string
+		advertised bool
+	}{
+		{"X-TEST", true},
+		{"SIZE", true},
+		{"AUTH", false},
+	} {
+		if ok, _ := c.Extension(v.extension); ok != v.advertised {
+			t.Fatal(fmt.Errorf("%s advertised: %t", v.extension, ok))
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+}
+
+func TestParams(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + "> X-UNKNOWN=1", 555},
+		{"MAIL FROM:<" + testEmail1 + "> SIZE=1=2", 501},
+		{"MAIL FROM:<" + testEmail1 + "> SIZE=1 SIZE=2", 501},
+		{"MAIL FROM:<" + testEmail1 + "> BODY=UNKNOWN", 501},
+		{"MAIL FROM:<jürgen@münchen.de>", 553},
+		{"MAIL FROM:<jürgen@münchen.de> SMTPUTF8=1", 501},
+		{"MAIL FROM:<jürgen@münchen.de> SMTPUTF8", 250},
+		{"RCPT TO:<用户@例子.测试>", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<" + testEmail1 + "> BODY=BINARYMIME", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 503},
+		{"RSET", 250},
+		{"MAIL FROM:<" + testEmail1 + "> RET=PARTIAL", 501},
+		{"MAIL FROM:<" + testEmail1 + "> size=100 AUTH=<>", 250},
+		{"RCPT TO:<" + testEmail2 + "> X-UNKNOWN", 555},
+		{"RCPT TO:<" + testEmail2 + "> NOTIFY=NEVER,DELAY", 501},
+		{"RCPT TO:<" + testEmail2 + "> ORCPT=rfc822;a+4", 501},
+		{"RCPT TO:<" + testEmail2 + "> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b+40localhost", 250},
+		{"DATA", 354},
+		{".", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if p := map[string]string{"SIZE": "100", "AUTH": "<>"}; !reflect.DeepEqual(m.Params, p) {
+		t.Fatal(fmt.Errorf("%v != %v", m.Params, p))
+	}
+	r := &Recipient{
+		Address:   testEmail2,
+		Notify:    []string{"SUCCESS", "FAILURE"},
+		ORcptType: "rfc822",
+		ORcpt:     testEmail2,
+		Params: map[string]string{
+			"NOTIFY": "SUCCESS,FAILURE",
+			"ORCPT":  "rfc822;b+40localhost",
+		},
+	}
+	if !reflect.DeepEqual(m.Recipients, []*Recipient{r}) {
+		t.Fatal(fmt.Errorf("%v != %v", m.Recipients[0], r))
+	}
+}
+
+func TestReplies(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		Replies: map[string]Reply{
+			"rcpt.ok": {CodeOK, "2.1.5", "recipient accepted"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("ENHANCEDSTATUSCODES"); !ok {
+		t.Fatal(errors.New("ENHANCEDSTATUSCODES should have been advertised"))
+	}
+	for _, v := range []struct {
+		line string
+		code int
+		msg  string
+	}{
+		{"MAIL FROM:<" + testEmail1 + ">", 250, "2.1.0 ok"},
+		{"RCPT TO:<" + testEmail2 + ">", 250, "2.1.5 recipient accepted"},
+		{"XUNKNOWN", 502, "5.5.1 unsupported command"},
+	} {
+		if err := c.Text.PrintfLine("%s", v.line); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := c.Text.ReadResponse(v.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != v.msg {
+			t.Fatal(fmt.Errorf("%s != %s", msg, v.msg))
+		}
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+}
+
+func TestVerify(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		VerifyAddress: func(c *Client, address string) Reply {
+			if address == testEmail1 {
+				return Reply{CodeOK, "2.1.5", address}
+			}
+			return ReplyCannotVerify()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"VRFY " + testEmail1, 250},
+		{"VRFY " + testEmail2, 252},
+		{"VRFY", 501},
+		{"EXPN list", 502},
+		{"QUIT", 221},
+	})
+	s.Close(false)
+	s, err = NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		ExpandList: func(c *Client, list string) Reply {
+			return Reply{CodeOK, "2.0.0", "<" + testEmail1 + ">\n<" + testEmail2 + ">"}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+	})
+	if err := c.PrintfLine("EXPN list"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "2.0.0 <"+testEmail1+">\n2.0.0 <"+testEmail2+">" {
+		t.Fatal(fmt.Errorf("unexpected reply %q", msg))
+	}
+	testCommands(t, c, []testCommand{
+		{"VRFY " + testEmail1, 502},
+		{"QUIT", 221},
+	})
+	s.Close(false)
+}
+
+func TestHelp(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+	})
+	for _, v := range []struct {
+		line string
+		code int
+		msg  string
+	}{
+		{"HELP MAIL", 214, "2.0.0 MAIL FROM:<address> [parameters]"},
+		{"HELP XUNKNOWN", 504, "5.5.1 no help available for XUNKNOWN"},
+		{"HELP STARTTLS", 504, "5.5.1 no help available for STARTTLS"},
+		{"HELP AUTH", 504, "5.5.1 no help available for AUTH"},
+		{"HELP VRFY", 504, "5.5.1 no help available for VRFY"},
+		{"HELP EXPN", 504, "5.5.1 no help available for EXPN"},
+	} {
+		if err := c.PrintfLine("%s", v.line); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := c.ReadResponse(v.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != v.msg {
+			t.Fatal(fmt.Errorf("%s != %s", msg, v.msg))
+		}
+	}
+	if err := c.PrintfLine("HELP"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(214)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(msg, "\n")
+	if len(lines) != 2 {
+		t.Fatal(fmt.Errorf("unexpected reply %q", msg))
+	}
+	for _, cmd := range commands {
+		if strings.Contains(lines[0], " "+cmd.name) != (cmd.enabled == nil || cmd.enabled(&Config{})) {
+			t.Fatal(fmt.Errorf("%s listed incorrectly in %q", cmd.name, lines[0]))
+		}
+	}
+	if !strings.Contains(lines[1], " PIPELINING") {
+		t.Fatal(fmt.Errorf("PIPELINING missing from %q", lines[1]))
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	s.Close(false)
+}
+
+func TestLMTP(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		LMTP: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 502},
+		{"EHLO localhost", 502},
+		{"LHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"RCPT TO:<" + testEmail3 + ">", 250},
+		{"DATA", 354},
+	})
+	if err := c.PrintfLine("%s\r\n.", content); err != nil {
+		t.Fatal(err)
+	}
+	// One reply is expected for each recipient
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	s.Close(false)
+	if m := <-messages; m == nil || len(m.Recipients) != 2 {
+		t.Fatal(fmt.Errorf("unexpected message %v", m))
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		t.Fatal(errors.New("PIPELINING should have been advertised"))
+	}
+	// Send the whole group of commands in a single write and then read the
+	// replies in order
+	if _, err := fmt.Fprintf(c.Text.W, "MAIL FROM:<%s>\r\nRCPT TO:<%s>\r\nRCPT TO:<%s>\r\nDATA\r\n",
+		testEmail1, testEmail2, testEmail3); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 250, 250, 354} {
+		if _, _, err := c.Text.ReadResponse(code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testCommands(t, c.Text, []testCommand{
+		{content + "\r\n.", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if !reflect.DeepEqual(m.To, []string{testEmail2, testEmail3}) {
+		t.Fatal(fmt.Errorf("unexpected recipients %v", m.To))
+	}
+}
+
+func TestChunking(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// Each chunk includes the CRLF appended by PrintfLine
+	var (
+		i    = strings.Index(content, "\r\n")
+		body = content + "\r\n"
+	)
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"BDAT 2 LAST\r\n", 503},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{fmt.Sprintf("BDAT %d\r\n%s", i+2, content[:i]), 250},
+		{"DATA", 503},
+		{fmt.Sprintf("BDAT %d LAST\r\n%s", len(body)-i-2, content[i+2:]), 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.Body != body {
+		t.Fatal(fmt.Errorf("%q != %q", m.Body, body))
+	}
+	if m.Checksum != sha256.Sum256([]byte(body)) {
+		t.Fatal(errors.New("checksum mismatch"))
+	}
+}
+
+func TestSTARTTLSReset(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&Config{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: tlsConfig,
+		Authenticator: func(mechanism, username, password string) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"STARTTLS", 220},
+	})
+	// The transaction and greeting must be forgotten after the upgrade
+	c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+	testCommands(t, c, []testCommand{
+		{"MAIL FROM:<" + testEmail1 + ">", 503},
+		{"EHLO localhost", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 503},
+		{"AUTH PLAIN AHVzZXIAcGFzcw==", 235},
+	})
+	// AUTH must no longer be advertised
+	if err := c.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg, "AUTH") || strings.Contains(msg, "STARTTLS") {
+		t.Fatal(fmt.Errorf("unexpected extensions: %s", msg))
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+// benchmarkServer creates a server that discards all messages it receives.
+func benchmarkServer(b *testing.B, config *Config) *Server {
+	config.Addr = "127.0.0.1:0"
+	s, err := NewServer(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		for range s.NewMessage {
+		}
+	}()
+	return s
+}
+
+// benchmarkSend sends a single message with the specified body.
+func benchmarkSend(b *testing.B, c *smtp.Client, body []byte) {
+	if err := c.Mail(testEmail1); err != nil {
+		b.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		b.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkMessages(b *testing.B) {
+	s := benchmarkServer(b, &Config{})
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkSend(b, c, []byte(content))
+	}
+	b.StopTimer()
+	c.Quit()
+	s.Close(false)
+}
+
+func BenchmarkLargeMessage(b *testing.B) {
+	var (
+		s    = benchmarkServer(b, &Config{})
+		line = strings.Repeat("x", 76) + "\r\n"
+		body = []byte(strings.Repeat(line, (10<<20)/len(line)))
+	)
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkSend(b, c, body)
+	}
+	b.StopTimer()
+	c.Quit()
+	s.Close(false)
+}
+
+// BenchmarkIdleSessions measures the cost of establishing idle sessions. Both
+// ends of each connection are in this process, so the number of sessions is
+// kept well below common file descriptor limits.
+func BenchmarkIdleSessions(b *testing.B) {
+	const sessions = 4000
+	s := benchmarkServer(b, &Config{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conns := make([]*textproto.Conn, 0, sessions)
+		for j := 0; j < sessions; j++ {
+			c, err := textproto.Dial("tcp", s.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := c.ReadResponse(220); err != nil {
+				b.Fatal(err)
+			}
+			conns = append(conns, c)
+		}
+		b.StopTimer()
+		for _, c := range conns {
+			c.Close()
+		}
+		b.StartTimer()
+	}
+	b.StopTimer()
+	s.Close(false)
+}
+
+// testTLSConfig generates a self-signed certificate for use with STARTTLS.
+func testTLSConfig() (*tls.Config, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	t := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	b, err := x509.CreateCertificate(rand.Reader, t, t, &k.PublicKey, k)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{b}, PrivateKey: k},
+		},
+	}, nil
+}
+
+func TestSTARTTLS(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		s *Server
+	)
+	s, err = NewServer(&Config{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: tlsConfig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The extension must be advertised before it can be used
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal(errors.New("STARTTLS should have been advertised"))
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Once TLS is active, the extension should no longer be offered
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Fatal(errors.New("STARTTLS should not have been advertised"))
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := c.Data(); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Write([]byte(content))
+		w.Close()
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.Session.TLS == nil || !m.Session.TLS.HandshakeComplete {
+		t.Fatal(errors.New("TLS state should have been recorded"))
+	}
+	if m.TLSVersion == 0 || m.TLSCipherSuite == 0 {
+		t.Fatal(errors.New("TLS version and cipher suite should have been recorded"))
+	}
+}
+
+func TestAuth(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			Authenticator: func(mechanism, username, password string) error {
+				if username != "user" || password != "pass" {
+					return errors.New("invalid credentials")
+				}
+				return nil
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	// Invalid credentials must be rejected (net/smtp disconnects afterwards)...
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user", "wrong", "127.0.0.1")); err == nil {
+		t.Fatal(errors.New("AUTH should not have succeeded"))
+	}
+	// ...and valid ones accepted
+	c, err = smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user", "pass", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := c.Data(); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Write([]byte(content))
+		w.Close()
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	// Use LOGIN on a raw connection since net/smtp does not implement it
+	conn, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, conn, []testCommand{
+		{"EHLO localhost", 250},
+		{"AUTH LOGIN", 334},
+		{base64.StdEncoding.EncodeToString([]byte("user")), 334},
+		{base64.StdEncoding.EncodeToString([]byte("pass")), 235},
+		{"QUIT", 221},
+	})
+	conn.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.AuthUser != "user" {
+		t.Fatal(fmt.Errorf("%s != user", m.AuthUser))
+	}
+}
+
+func TestAuthCRAMMD5(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		LookupSecret: func(username string) (string, error) {
+			if username != "user" {
+				return "", errors.New("unknown user")
+			}
+			return "secret", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		username string
+		secret   string
+		valid    bool
+	}{
+		{"user", "wrong", false},
+		{"nobody", "secret", false},
+		{"user", "secret", true},
+	} {
+		c, err := smtp.Dial(s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Auth(smtp.CRAMMD5Auth(v.username, v.secret))
+		if v.valid && err != nil {
+			t.Fatal(err)
+		}
+		if !v.valid && err == nil {
+			t.Fatal(errors.New("AUTH should not have succeeded"))
+		}
+		c.Close()
+	}
+	s.Close(false)
+}
+
+// xoauth2Auth implements the client side of XOAUTH2 for net/smtp.
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func TestAuthXOAUTH2(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		ValidateToken: func(username, token string) error {
+			if username != "user" || token != "token" {
+				return errors.New("invalid token")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		token string
+		valid bool
+	}{
+		{"wrong", false},
+		{"token", true},
+	} {
+		c, err := smtp.Dial(s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Auth(&xoauth2Auth{"user", v.token})
+		if v.valid && err != nil {
+			t.Fatal(err)
+		}
+		if !v.valid && err == nil {
+			t.Fatal(errors.New("AUTH should not have succeeded"))
+		}
+		c.Close()
+	}
+	s.Close(false)
+}
+
+func TestRequireTLSAndAuth(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&Config{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: tlsConfig,
+		Authenticator: func(mechanism, username, password string) error {
+			return nil
+		},
+		RequireTLS:  true,
+		RequireAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neither AUTH nor MAIL should be accepted over plaintext
+	conn, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, conn, []testCommand{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN AHVzZXIAcGFzcw==", 530},
+		{"MAIL FROM:<" + testEmail1 + ">", 530},
+		{"QUIT", 221},
+	})
+	conn.Close()
+	// Both should succeed after STARTTLS and AUTH
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "user", "pass", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+}
+
+func TestSenderTLSPolicy(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&Config{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: tlsConfig,
+		SenderTLSPolicy: map[string]TLSPolicy{
+			"localhost":   TLSRequired,
+			"example.com": TLSVerified,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, conn, []testCommand{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 530},
+		{"MAIL FROM:<a@EXAMPLE.COM>", 530},
+		{"MAIL FROM:<a@example.org>", 250},
+		{"QUIT", 221},
+	})
+	conn.Close()
+	// Mail from domains requiring TLS is accepted after STARTTLS, but the
+	// client did not present a certificate
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("a@example.com"); err == nil {
+		t.Fatal(errors.New("sender should have been rejected"))
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+}
+
+func TestNullReversePath(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<> SIZE=10", 250},
+		{"MAIL FROM:<>", 503},
+		{"RCPT TO:<" + testEmail1 + ">", 250},
+		{"DATA", 354},
+		{content + "\r\n.", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil || len(m.From) != 0 || len(m.To) != 1 {
+		t.Fatal(errors.New("message with empty sender expected"))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Ready() {
+		t.Fatal(errors.New("server should be ready"))
+	}
+	addr := s.Addr().String()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Drain(0); n != 1 {
+		t.Fatal(fmt.Errorf("unexpected session count %d", n))
+	}
+	if s.Ready() {
+		t.Fatal(errors.New("server should not be ready"))
+	}
+	if _, err := textproto.Dial("tcp", addr); err == nil {
+		t.Fatal(errors.New("connection should have been refused"))
+	}
+	// The existing client is unaffected
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	closeWithin(t, s, false, 5*time.Second)
+}
+
+func TestAddressCase(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	if err := smtp.SendMail(
+		s.Addr().String(),
+		nil,
+		"Sender@EXAMPLE.com",
+		[]string{"John.Doe@Example.COM"},
+		[]byte(content),
+	); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.From != "Sender@example.com" || m.To[0] != "John.Doe@example.com" ||
+		m.Recipients[0].Address != "John.Doe@example.com" {
+		t.Fatal(fmt.Errorf("unexpected addresses %s %v", m.From, m.To))
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	var (
+		b            bytes.Buffer
+		server, peer = net.Pipe()
+		c            = newClient(&Config{Journal: &b}, nil, server)
+	)
+	peer.Close()
+	c.finishMessage(&Message{From: testEmail1}, time.Now(), nil)
+	var e journalEntry
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Result != "unacknowledged" {
+		t.Fatal(fmt.Errorf("unexpected result %s", e.Result))
+	}
+	// The session ends instead of waiting for a command
+	c.reply("noop.ok")
+	if _, err := c.readLine(maxCommandLine, 0); err == nil {
+		t.Fatal(errors.New("error expected"))
+	}
+}
+
+func TestAbort(t *testing.T) {
+	var (
+		aborted = make(chan string, 10)
+		s, err  = NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			OnAbort: func(c *Client) {
+				aborted <- c.mailFrom
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"EHLO localhost", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 503},
+		{"MAIL FROM:<" + testEmail2 + ">", 250},
+	})
+	c.Close()
+	s.Close(false)
+	close(aborted)
+	var from []string
+	for f := range aborted {
+		from = append(from, f)
+	}
+	if !reflect.DeepEqual(from, []string{testEmail1, testEmail2}) {
+		t.Fatal(fmt.Errorf("unexpected aborted transactions %v", from))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	var (
+		addr   = s.Addr().String()
+		conns  = []*textproto.Conn{}
+		result = make(chan error)
+	)
+	for i := 0; i < 2; i++ {
+		c, err := textproto.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	// The first client is idle while the second is sending a message
+	testCommands(t, conns[0], []testCommand{
+		{"HELO localhost", 250},
+	})
+	testCommands(t, conns[1], []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result <- s.Shutdown(ctx)
+	}()
+	if _, _, err := conns[0].ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, conns[1], []testCommand{
+		{content + "\r\n.", 250},
+	})
+	if _, _, err := conns[1].ReadResponse(421); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if m := <-messages; m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal(errors.New("client should have been disconnected"))
+	}
+}
+
+func TestBeforeHelo(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"NOOP", 250},
+		{"RSET", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 503},
+		{"DATA", 503},
+		{"BOGUS", 502},
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+func TestServe(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		s = New(&Config{
+			TLSConfig: tlsConfig,
+			OnConnect: func(c *Client) error {
+				if c.Session().TLS == nil {
+					return errors.New("expected TLS")
+				}
+				return nil
+			},
+		})
+		served = make(chan error)
+	)
+	go func() {
+		served <- s.Serve(tls.NewListener(l, tlsConfig))
+	}()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PrintfLine("EHLO localhost"); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg, "STARTTLS") {
+		t.Fatal("STARTTLS advertised with implicit TLS")
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("%v != %v", err, ErrServerClosed)
+	}
+	if err := s.Serve(l); err != ErrServerClosed {
+		t.Fatalf("%v != %v", err, ErrServerClosed)
+	}
+}
+
+func TestMetadataHeaders(t *testing.T) {
+	var (
+		s, err = NewServer(&Config{
+			Addr:           "127.0.0.1:0",
+			MetadataPrefix: "X-SMTPSrv-",
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO client.example.com", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	// Headers with the prefix supplied by the client must be removed
+	if err := c.PrintfLine("X-SMTPSrv-Auth-User: forged\r\n%s\r\n.", content); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	b := fmt.Sprintf(
+		"X-SMTPSrv-Client-IP: 127.0.0.1\r\n"+
+			"X-SMTPSrv-Helo: client.example.com\r\n"+
+			"X-SMTPSrv-Listener: %s\r\n%s",
+		m.Session.LocalAddr,
+		content,
+	)
+	if m.Body != b {
+		t.Fatal(fmt.Errorf("%q != %q", m.Body, b))
+	}
+}
+
+func TestMetadataAuthUser(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:           "127.0.0.1:0",
+		MetadataPrefix: "X-SMTPSrv-",
+		Authenticator: func(mechanism, username, password string) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO client.example.com", 250},
+		// "user\r\nX-SMTPSrv-Auth-User: admin" would inject a header
+		{"AUTH PLAIN AHVzZXINClgtU01UUFNydi1BdXRoLVVzZXI6IGFkbWluAHBhc3M=", 501},
+		{"AUTH PLAIN AHVzZXIAcGFzcw==", 235},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+		{content + "\r\n.", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if !strings.Contains(m.Body, "X-SMTPSrv-Auth-User: user\r\n") || strings.Contains(m.Body, "admin") {
+		t.Fatalf("unexpected body %q", m.Body)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	tlsConfig, err := testTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(chan string, 1)
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		Listeners: []*Listener{
+			{
+				Name:        "submissions",
+				Addr:        "127.0.0.1:0",
+				ImplicitTLS: true,
+				Config: &Config{
+					TLSConfig:   tlsConfig,
+					RequireAuth: true,
+					OnConnect: func(c *Client) error {
+						names <- c.Session().Listener
+						return nil
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr string
+	s.mutex.Lock()
+	for l, li := range s.listeners {
+		if li.Name == "submissions" {
+			addr = l.Addr().String()
+		}
+	}
+	s.mutex.Unlock()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-names; n != "submissions" {
+		t.Fatalf("%q != %q", n, "submissions")
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 530},
+		{"QUIT", 221},
+	})
+	c.Close()
+	// The listener on Addr continues to use the server's configuration
+	c, err = textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+func TestTrustedRelays(t *testing.T) {
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	s, err := NewServer(&Config{
+		Addr:          "127.0.0.1:0",
+		TrustedRelays: []*net.IPNet{n},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "Received: from client ([192.0.2.1]) by relay\r\n\r\n"+content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if ip := net.ParseIP("192.0.2.1"); !m.OriginIP.Equal(ip) {
+		t.Fatalf("%s != %s", m.OriginIP, ip)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	for _, config := range []*Config{
+		{Addr: "127.0.0.1:0", MaxConnections: 1},
+		{Addr: "127.0.0.1:0", MaxConnectionsPerIP: 1},
+	} {
+		s, err := NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, err := textproto.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c1.ReadResponse(220); err != nil {
+			t.Fatal(err)
+		}
+		c2, err := textproto.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c2.ReadResponse(421); err != nil {
+			t.Fatal(err)
+		}
+		c2.Close()
+		testCommands(t, c1, []testCommand{
+			{"QUIT", 221},
+		})
+		c1.Close()
+		s.Close(false)
+	}
+}
+
+func TestQueueConnections(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:             "127.0.0.1:0",
+		MaxConnections:   1,
+		QueueConnections: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c1.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// The second client is not greeted until the first disconnects
+	c2, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeted := make(chan error)
+	go func() {
+		_, _, err := c2.ReadResponse(220)
+		greeted <- err
+	}()
+	select {
+	case <-greeted:
+		t.Fatal(errors.New("second client greeted while at the limit"))
+	case <-time.After(100 * time.Millisecond):
+	}
+	testCommands(t, c1, []testCommand{
+		{"QUIT", 221},
+	})
+	c1.Close()
+	if err := <-greeted; err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+	s.Close(false)
+}
+
+func TestQuirks(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:   "127.0.0.1:0",
+		Quirks: QuirkNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO", 501},
+		{"HELO localhost", 250},
+		{"MAIL FROM: <" + testEmail1 + ">", 501},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO: <" + testEmail2 + ">", 501},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	if err := c.PrintfLine("Subject: caf\xc3\xa9\r\n\r\ntest\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(554); err != nil {
+		t.Fatal(err)
+	}
+	// Bare LFs cause the client to be disconnected
+	if _, err := c.W.WriteString("NOOP\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	if _, _, err := c.ReadResponse(500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Fatalf("%v != %v", err, io.EOF)
+	}
+	c.Close()
+	s.Close(false)
+}
+
+func TestQuirksTolerated(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO", 250},
+		{"MAIL FROM: <" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+	})
+	if _, err := c.W.WriteString("Subject: test\n\ntest\r\n.\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.W.Flush()
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.Helo != "[127.0.0.1]" {
+		t.Fatalf("%q != %q", m.Helo, "[127.0.0.1]")
+	}
+	q := QuirkHeloWithoutHostname | QuirkSpaceAfterColon | QuirkBareLF
+	if m.Session.Quirks != q {
+		t.Fatalf("%s != %s", m.Session.Quirks, q)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:    "127.0.0.1:0",
+		Workers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c1.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	// The second client waits in the queue until the worker is free
+	c2, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeted := make(chan error)
+	go func() {
+		_, _, err := c2.ReadResponse(220)
+		greeted <- err
+	}()
+	select {
+	case <-greeted:
+		t.Fatal(errors.New("second client greeted while the worker was busy"))
+	case <-time.After(100 * time.Millisecond):
+	}
+	testCommands(t, c1, []testCommand{
+		{"QUIT", 221},
+	})
+	c1.Close()
+	if err := <-greeted; err != nil {
+		t.Fatal(err)
+	}
+	// Clients still connected are disconnected when the server is closed
+	closeWithin(t, s, true, time.Second)
+	c2.Close()
+}
+
+func TestAllowlist(t *testing.T) {
+	var (
+		mutex      sync.Mutex
+		paced      []string
+		allowlists []bool
+	)
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		Allowlist: func(c *Client, from, to string) bool {
+			return from == testEmail1 && to == testEmail2
+		},
+		OnRcpt: func(c *Client, to string, params map[string]string) error {
+			allowlists = append(allowlists, c.Allowlisted())
+			return nil
+		},
+		Pace: func(c *Client) time.Duration {
+			mutex.Lock()
+			defer mutex.Unlock()
+			paced = append(paced, fmt.Sprint(c.Allowlisted()))
+			return 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail(testEmail1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt(testEmail2); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if !m.Allowlisted() || len(allowlists) != 1 || !allowlists[0] {
+		t.Fatal(errors.New("allowlisted transaction expected"))
+	}
+	// The client is no longer paced once the transaction is allowlisted
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, p := range paced {
+		if p != "false" {
+			t.Fatalf("paced while allowlisted: %v", paced)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		commands int
+	)
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		RateLimiter: RateLimiterFunc(func(ip net.IP, event RateEvent) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if event == RateMessage {
+				return false
+			}
+			commands++
+			return commands <= 3
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 450},
+		{"NOOP", 250},
+		{"NOOP", 421},
+	})
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Fatalf("%v != %v", err, io.EOF)
+	}
+	c.Close()
+	s.Close(false)
+}
+
+func TestBlocklists(t *testing.T) {
+	resolver := testResolver{
+		"1.0.0.127.bl.example.com": {"127.0.0.2"},
+	}
+	s, err := NewServer(&Config{
+		Addr:       "127.0.0.1:0",
+		Blocklists: []string{"ok.example.com", "bl.example.com"},
+		Resolver:   resolver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadResponse(554); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(msg, "bl.example.com") {
+		t.Fatalf("%q does not name the blocklist", msg)
+	}
+	c.Close()
+	s.Close(false)
+	// With the tag policy, mail is accepted and the message records the
+	// blocklists that list the client
+	s, err = NewServer(&Config{
+		Addr:            "127.0.0.1:0",
+		Blocklists:      []string{"bl.example.com"},
+		BlocklistAtMail: true,
+		BlocklistPolicy: BlocklistTag,
+		Resolver:        resolver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	if err := smtp.SendMail(s.Addr().String(), nil, testEmail1, []string{testEmail2}, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if len(m.Blocklists) != 1 || m.Blocklists[0] != "bl.example.com" {
+		t.Fatalf("%v != [bl.example.com]", m.Blocklists)
+	}
+}
+
+func TestSPF(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:          "127.0.0.1:0",
+		CheckSPF:      true,
+		RejectSPFFail: true,
+		Resolver: testResolver{
+			"txt:pass.example.com": {"v=spf1 ip4:127.0.0.0/8 -all"},
+			"txt:fail.example.com": {"v=spf1 -all"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<a@fail.example.com>", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 550},
+		{"RSET", 250},
+		{"MAIL FROM:<a@pass.example.com>", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"DATA", 354},
+		{content + "\r\n.", 250},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.SPF != SPFPass {
+		t.Fatalf("%s != %s", m.SPF, SPFPass)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:         "127.0.0.1:0",
+		DecodeLimits: &DecodeLimits{MaxDepth: 1},
+		Handler: HandlerFunc(func(ctx context.Context, m *Message) error {
+			_, err := m.Parse()
+			return err
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = smtp.SendMail(s.Addr().String(), nil, testEmail1, []string{testEmail2}, []byte(nestedMessage(2)))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 554 || !strings.Contains(e.Msg, "depth") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s.Close(false)
+}
+
+func TestDMARC(t *testing.T) {
+	s, err := NewServer(&Config{
+		Addr:         "127.0.0.1:0",
+		CheckSPF:     true,
+		CheckDMARC:   true,
+		EnforceDMARC: DMARCPolicyReject,
+		Resolver: testResolver{
+			"txt:example.com":        {"v=spf1 ip4:127.0.0.1 -all"},
+			"txt:_dmarc.example.com": {"v=DMARC1; p=reject"},
+			"txt:_dmarc.example.net": {"v=DMARC1; p=reject"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	err = smtp.SendMail(s.Addr().String(), nil, "a@example.com", []string{testEmail2},
+		[]byte("From: <b@example.net>\r\n\r\n"+content))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := smtp.SendMail(s.Addr().String(), nil, "a@example.com", []string{testEmail2},
+		[]byte("From: <b@example.com>\r\n\r\n"+content)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	m := <-messages
+	if m == nil {
+		t.Fatal(errors.New("message expected"))
+	}
+	if m.DMARC == nil || m.DMARC.Result != "pass" || !m.DMARC.SPFAligned {
+		t.Fatalf("unexpected result %+v", m.DMARC)
+	}
+}
+
+func TestOnFinish(t *testing.T) {
+	dispositions := make(chan Disposition, 2)
+	s, err := NewServer(&Config{
+		Addr:           "127.0.0.1:0",
+		MaxMessageSize: 100,
+		OnFinish: func(c *Client, m *Message) {
+			dispositions <- m.Disposition
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := captureMessage(s)
+	if err := smtp.SendMail(s.Addr().String(), nil, testEmail1, []string{testEmail2}, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(s.Addr().String(), nil, testEmail1, []string{testEmail2}, []byte(strings.Repeat("a", 200))); err == nil {
+		t.Fatal("error expected")
+	}
+	s.Close(false)
+	<-messages
+	for _, exp := range []Disposition{DispositionAccepted, "rejected:data.too-large"} {
+		if d := <-dispositions; d != exp {
+			t.Fatalf("%s != %s", d, exp)
+		}
+	}
+}
+
+func TestDispositionBeforeData(t *testing.T) {
+	var (
+		b        bytes.Buffer
+		finished = make(chan *Message, 4)
+		s, err   = NewServer(&Config{
+			Addr:    "127.0.0.1:0",
+			Journal: &b,
+			OnMail: func(c *Client, from string, params map[string]string) error {
+				if from == testEmail3 {
+					return errors.New("rejected")
+				}
+				return nil
+			},
+			OnRcpt: func(c *Client, to string, params map[string]string) error {
+				if to == testEmail3 {
+					return &SMTPError{CodeMailboxBusy, "4.2.1", "try later"}
+				}
+				return nil
+			},
+			OnFinish: func(c *Client, m *Message) {
+				finished <- m
+			},
+		})
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail3 + ">", 550},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail3 + ">", 450},
+		{"RSET", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+		{"RCPT TO:<" + testEmail3 + ">", 450},
+		{"QUIT", 221},
+	})
+	c.Close()
+	for _, v := range []struct {
+		from        string
+		recipients  int
+		disposition Disposition
+	}{
+		{testEmail3, 0, "rejected:mail.rejected"},
+		{testEmail1, 0, "deferred:rcpt.rejected"},
+		{testEmail1, 1, DispositionAbandoned},
+	} {
+		m := <-finished
+		if m.From != v.from || len(m.Recipients) != v.recipients || m.Disposition != v.disposition {
+			t.Fatalf("unexpected message %+v", m)
+		}
+	}
+	s.Close(false)
+	var results []string
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var e journalEntry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, e.Result+" "+e.Disposition)
+	}
+	if strings.Join(results, ",") != "rejected rejected:mail.rejected,rejected deferred:rcpt.rejected,abandoned abandoned" {
+		t.Fatalf("unexpected results %v", results)
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	// AUTH is not implemented without a mechanism
+	s, err := NewServer(&Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"AUTH PLAIN", 502},
+	})
+	c.Close()
+	s.Close(false)
+	// Errors from the authenticator are passed along and failed attempts
+	// count toward MaxErrors even when other commands succeed
+	s, err = NewServer(&Config{
+		Addr:      "127.0.0.1:0",
+		MaxErrors: 2,
+		Authenticator: func(mechanism, username, password string) error {
+			if username == "unavailable" {
+				return &SMTPError{CodeTempAuthFailure, "4.7.0", "try again later"}
+			}
+			return errors.New("invalid credentials")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	plain := func(username string) string {
+		return "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00"+username+"\x00pass"))
+	}
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{plain("unavailable"), 454},
+		{"NOOP", 250},
+		{plain("user"), 535},
+		{"NOOP", 421},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	var (
+		block    = make(chan struct{})
+		b        bytes.Buffer
+		handlers = []Handler{
+			// A handler that never returns...
+			HandlerFunc(func(ctx context.Context, m *Message) error {
+				<-block
+				return nil
+			}),
+			// ...and one that returns the context's error
+			HandlerFunc(func(ctx context.Context, m *Message) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}),
+		}
+	)
+	defer close(block)
+	for _, h := range handlers {
+		b.Reset()
+		s, err := NewServer(&Config{
+			Addr:           "127.0.0.1:0",
+			MessageTimeout: 50 * time.Millisecond,
+			Handler:        h,
+			Journal:        &b,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = smtp.SendMail(s.Addr().String(), nil, testEmail1, []string{testEmail2}, []byte(content))
+		if e, ok := err.(*textproto.Error); !ok || e.Code != 451 || !strings.Contains(e.Msg, "4.4.5") {
+			t.Fatalf("unexpected error %v", err)
+		}
+		s.Close(false)
+		var e journalEntry
+		if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Result != "timeout" {
+			t.Fatalf("%s != timeout", e.Result)
+		}
+	}
+}
+
+func TestCommandLineLimits(t *testing.T) {
+	token := strings.Repeat("t", 1200)
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		ValidateToken: func(username, t string) error {
+			if t != token {
+				return errors.New("invalid token")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		initial = base64.StdEncoding.EncodeToString([]byte("user=user\x01auth=Bearer " + token + "\x01\x01"))
+		orcpt   = "rfc822;" + strings.Repeat("b", 480) + "@localhost"
+	)
+	testCommands(t, c, []testCommand{
+		{"EHLO localhost", 250},
+		{"NOOP " + strings.Repeat("x", 600), 500},
+		{"AUTH XOAUTH2 " + initial, 235},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + "> ORCPT=" + orcpt, 250},
+		{"RCPT TO:<" + testEmail3 + "> ORCPT=" + orcpt + strings.Repeat("c", 500), 500},
+		{"QUIT", 221},
+	})
+	c.Close()
+	s.Close(false)
+}
+
+func TestShutdownStuckClient(t *testing.T) {
+	var (
+		entered = make(chan struct{})
+		block   = make(chan struct{})
+	)
+	s, err := NewServer(&Config{
+		Addr: "127.0.0.1:0",
+		// A hook cannot be interrupted, so the client cannot be disconnected
+		// until it returns
+		OnData: func(c *Client) error {
+			close(entered)
+			<-block
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := textproto.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	testCommands(t, c, []testCommand{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<" + testEmail1 + ">", 250},
+		{"RCPT TO:<" + testEmail2 + ">", 250},
+	})
+	if err := c.PrintfLine("DATA"); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	returned := make(chan error, 1)
+	go func() {
+		returned <- s.Shutdown(ctx)
+	}()
+	select {
+	case err := <-returned:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	// Once the client is gone, closing the server again is harmless
+	close(block)
+	closeWithin(t, s, false, 2*time.Second)
+	closeWithin(t, s, false, 2*time.Second)
+	if _, ok := <-s.NewMessage; ok {
+		t.Fatal("NewMessage should be closed")
+	}
 }
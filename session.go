@@ -0,0 +1,79 @@
+package smtpsrv
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// Session describes the connection with a client. The session for a client
+// is available from its Session method while it is connected and a copy is
+// attached to each message it sends.
+type Session struct {
+	// Unique identifier for the session
+	ID string
+	// Address of the client (as supplied by the PROXY protocol header, if
+	// enabled) and the local address it connected to
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// Name of the listener the client connected to - empty for listeners
+	// passed to Serve and the one on Config.Addr
+	Listener string
+	// State of the TLS connection or nil if STARTTLS has not been used
+	TLS *tls.ConnectionState
+	// Banner sent to the client in the greeting, which is one of
+	// Config.Greetings if variants are configured
+	Greeting string
+	// Hostname supplied by the client with HELO or EHLO
+	Helo string
+	// Username supplied with AUTH or empty if the client has not
+	// authenticated
+	AuthUser string
+	// DNS blocklists that list the client, from Config.Blocklists
+	Blocklists []string
+	// Quirks the client has exhibited, whether or not they were tolerated
+	Quirks Quirk
+	// Time the client connected
+	Start time.Time
+	// Values shared between hooks during the session, such as the result of
+	// a check performed in one hook that is needed by another - keys should
+	// be of an unexported type to avoid collisions, as with context values
+	Values map[interface{}]interface{}
+}
+
+// newSessionID generates a random identifier for a session.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newSession creates the session for a new connection.
+func newSession(conn net.Conn) *Session {
+	return &Session{
+		ID:         newSessionID(),
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+		Start:      time.Now(),
+		Values:     map[interface{}]interface{}{},
+	}
+}
+
+// Session returns the session for the client. Other than Values, it must not
+// be modified.
+func (c *Client) Session() *Session {
+	return c.session
+}
+
+// snapshot returns a copy of the session as it currently stands, including
+// a copy of its values.
+func (c *Client) snapshot() *Session {
+	s := *c.session
+	s.Values = make(map[interface{}]interface{}, len(c.session.Values))
+	for k, v := range c.session.Values {
+		s.Values[k] = v
+	}
+	return &s
+}
@@ -0,0 +1,70 @@
+package smtpsrv
+
+import (
+	"context"
+	"time"
+)
+
+// Shutdown stops accepting connections and disconnects clients once they are
+// idle, sending them a 421 reply first. Clients waiting for a command are
+// disconnected immediately, while those in the middle of sending a message
+// are allowed to finish it. If the context expires first, the remaining
+// clients are disconnected and the context's error is returned without
+// waiting for them, since a client whose handler does not return cannot be
+// interrupted - NewMessage is closed once they are all gone. Shutdown is
+// used in place of Close, although calling both is harmless.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+	s.serving.Wait()
+	s.stopWorkers()
+	s.registry.each(func(c *Client) {
+		c.shutdown()
+	})
+	done := make(chan bool)
+	go func() {
+		s.registry.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.cancel()
+		go func() {
+			<-done
+			s.finish()
+		}()
+		return ctx.Err()
+	}
+	s.finish()
+	return nil
+}
+
+// shutdown asks the client to disconnect once it is idle. If it is currently
+// waiting for a command, the read is interrupted.
+func (c *Client) shutdown() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shuttingDown = true
+	if !c.idle {
+		return
+	}
+	// Closing the read side of the connection ensures that the read fails
+	// even if it has not yet begun, while still allowing the reply to be sent
+	if r, ok := c.raw.(interface {
+		CloseRead() error
+	}); ok {
+		r.CloseRead()
+		return
+	}
+	c.conn.SetReadDeadline(time.Now())
+}
+
+// setIdle indicates whether the client is waiting for a command. False is
+// returned if the server is shutting down, in which case the client should
+// be sent a 421 reply and disconnected.
+func (c *Client) setIdle(idle bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.idle = idle
+	return !c.shuttingDown
+}
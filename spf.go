@@ -0,0 +1,522 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPFResult is the result of an SPF check (RFC 7208 section 2.6).
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+const (
+	// Limits on the number of lookups performed by a single check (RFC 7208
+	// section 4.6.4)
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+	spfMaxMXNames     = 10
+	// Time allowed for a check (RFC 7208 section 4.6.4 suggests at least 20
+	// seconds)
+	spfTimeout = 20 * time.Second
+)
+
+var (
+	errSPFPerm = errors.New("SPF record is invalid or requires too many lookups")
+	errSPFTemp = errors.New("SPF lookup failed")
+)
+
+// spfQualifiers maps each qualifier to the result it produces when the
+// mechanism matches.
+var spfQualifiers = map[byte]SPFResult{
+	'+': SPFPass,
+	'-': SPFFail,
+	'~': SPFSoftFail,
+	'?': SPFNeutral,
+}
+
+// spfCheck holds the state of a single SPF check.
+type spfCheck struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// CheckSPF determines whether the client at ip is permitted to send mail
+// from the sender's domain (RFC 7208), using helo if the sender is empty, as
+// it is for the null reverse-path. The "ptr" mechanism, whose use is
+// discouraged, never matches.
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, sender, helo string) SPFResult {
+	if len(sender) == 0 {
+		sender = "postmaster@" + helo
+	}
+	i := strings.LastIndexByte(sender, '@')
+	if i == 0 {
+		sender = "postmaster" + sender
+		i = len("postmaster")
+	}
+	if i == -1 {
+		return SPFNone
+	}
+	s := &spfCheck{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	r, err := s.checkHost(sender[i+1:])
+	switch err {
+	case errSPFPerm:
+		return SPFPermError
+	case errSPFTemp:
+		return SPFTempError
+	}
+	return r
+}
+
+// lookupError classifies an error returned by the resolver. Names that do
+// not exist count as void lookups, of which only a few are allowed.
+func (s *spfCheck) lookupError(err error) error {
+	if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+		return s.void()
+	}
+	return errSPFTemp
+}
+
+// void counts a lookup that returned no records.
+func (s *spfCheck) void() error {
+	if s.voids++; s.voids > spfMaxVoidLookups {
+		return errSPFPerm
+	}
+	return nil
+}
+
+// count counts a term that requires a DNS lookup.
+func (s *spfCheck) count() error {
+	if s.lookups++; s.lookups > spfMaxLookups {
+		return errSPFPerm
+	}
+	return nil
+}
+
+// lookupRecord finds the SPF record for the domain, returning an empty
+// string if there is none.
+func (s *spfCheck) lookupRecord(domain string) (string, error) {
+	txts, err := s.resolver.LookupTXT(s.ctx, domain)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return "", nil
+		}
+		return "", errSPFTemp
+	}
+	var record string
+	for _, t := range txts {
+		if strings.EqualFold(t, "v=spf1") ||
+			len(t) > 7 && strings.EqualFold(t[:7], "v=spf1 ") {
+			if len(record) != 0 {
+				return "", errSPFPerm
+			}
+			record = t
+		}
+	}
+	return record, nil
+}
+
+// lookupIPs returns the addresses of the host in the same family as the
+// client's address.
+func (s *spfCheck) lookupIPs(host string) ([]net.IP, error) {
+	addrs, err := s.resolver.LookupHost(s.ctx, host)
+	if err != nil {
+		return nil, s.lookupError(err)
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && (ip.To4() == nil) == (s.ip.To4() == nil) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, s.void()
+	}
+	return ips, nil
+}
+
+// contains determines whether the client's address is within the network
+// described by ip and the prefix length for its family.
+func (s *spfCheck) contains(ip net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.ip.To4() != nil &&
+			(&net.IPNet{IP: ip4, Mask: net.CIDRMask(cidr4, 32)}).Contains(s.ip)
+	}
+	return s.ip.To4() == nil &&
+		(&net.IPNet{IP: ip, Mask: net.CIDRMask(cidr6, 128)}).Contains(s.ip)
+}
+
+// splitCIDR separates the domain-spec of an "a" or "mx" mechanism from its
+// dual CIDR length (such as "/24//64").
+func splitCIDR(arg string) (string, int, int, error) {
+	var (
+		cidr4 = 32
+		cidr6 = 128
+		err   error
+	)
+	if i := strings.Index(arg, "//"); i != -1 {
+		if cidr6, err = strconv.Atoi(arg[i+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+		arg = arg[:i]
+	}
+	if i := strings.LastIndexByte(arg, '/'); i != -1 {
+		if cidr4, err = strconv.Atoi(arg[i+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+		arg = arg[:i]
+	}
+	return arg, cidr4, cidr6, nil
+}
+
+// target expands the domain-spec of a mechanism, using the current domain
+// if there is none.
+func (s *spfCheck) target(spec, domain string) (string, error) {
+	if len(spec) == 0 {
+		return domain, nil
+	}
+	return s.expand(spec, domain)
+}
+
+// match determines whether a mechanism matches the client.
+func (s *spfCheck) match(name, arg, domain string) (bool, error) {
+	switch name {
+	case "all":
+		return true, nil
+	case "include":
+		if err := s.count(); err != nil {
+			return false, err
+		}
+		target, err := s.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		r, err := s.checkHost(target)
+		switch {
+		case err != nil:
+			return false, err
+		case r == SPFNone:
+			return false, errSPFPerm
+		}
+		return r == SPFPass, nil
+	case "a", "mx":
+		if err := s.count(); err != nil {
+			return false, err
+		}
+		spec, cidr4, cidr6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		target, err := s.target(spec, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := s.resolver.LookupMX(s.ctx, target)
+			if err != nil {
+				return false, s.lookupError(err)
+			}
+			if len(mxs) > spfMaxMXNames {
+				return false, errSPFPerm
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+			}
+		}
+		for _, h := range hosts {
+			ips, err := s.lookupIPs(h)
+			if err != nil {
+				return false, err
+			}
+			for _, ip := range ips {
+				if s.contains(ip, cidr4, cidr6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ptr":
+		return false, s.count()
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		ip, n, err := net.ParseCIDR(arg)
+		if err != nil || (name == "ip4") != (ip.To4() != nil) {
+			return false, errSPFPerm
+		}
+		return n.Contains(s.ip), nil
+	case "exists":
+		if err := s.count(); err != nil {
+			return false, err
+		}
+		target, err := s.expand(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := s.resolver.LookupHost(s.ctx, target)
+		if err != nil {
+			return false, s.lookupError(err)
+		}
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, s.void()
+	}
+	return false, errSPFPerm
+}
+
+// checkHost evaluates the SPF record of the domain (RFC 7208 section 4).
+func (s *spfCheck) checkHost(domain string) (SPFResult, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if !strings.Contains(domain, ".") || !validDomainName(domain, false) {
+		return SPFNone, nil
+	}
+	record, err := s.lookupRecord(domain)
+	if err != nil || len(record) == 0 {
+		return SPFNone, err
+	}
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers take the form "name=value"
+		if i := strings.IndexByte(term, '='); i != -1 &&
+			strings.IndexAny(term[:i], ":/") == -1 {
+			if strings.EqualFold(term[:i], "redirect") {
+				if len(redirect) != 0 {
+					return "", errSPFPerm
+				}
+				redirect = term[i+1:]
+			}
+			continue
+		}
+		result := SPFPass
+		if r, ok := spfQualifiers[term[0]]; ok {
+			result = r
+			term = term[1:]
+		}
+		name, arg := term, ""
+		if i := strings.IndexAny(term, ":/"); i != -1 {
+			name, arg = term[:i], strings.TrimPrefix(term[i:], ":")
+		}
+		ok, err := s.match(strings.ToLower(name), arg, domain)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return result, nil
+		}
+	}
+	if len(redirect) != 0 {
+		if err := s.count(); err != nil {
+			return "", err
+		}
+		target, err := s.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		r, err := s.checkHost(target)
+		if err == nil && r == SPFNone {
+			err = errSPFPerm
+		}
+		return r, err
+	}
+	return SPFNeutral, nil
+}
+
+// macroValue returns the value of a macro letter (RFC 7208 section 7.2).
+func (s *spfCheck) macroValue(letter byte, domain string) (string, error) {
+	i := strings.LastIndexByte(s.sender, '@')
+	switch letter {
+	case 's':
+		return s.sender, nil
+	case 'l':
+		return s.sender[:i], nil
+	case 'o':
+		return s.sender[i+1:], nil
+	case 'd':
+		return domain, nil
+	case 'i':
+		if s.ip.To4() != nil {
+			return s.ip.String(), nil
+		}
+		return reverseIPv6Forward(s.ip), nil
+	case 'p':
+		return "unknown", nil
+	case 'v':
+		if s.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'h':
+		return s.helo, nil
+	}
+	return "", errSPFPerm
+}
+
+// reverseIPv6Forward returns the nibbles of an IPv6 address separated by
+// dots, in their usual order.
+func reverseIPv6Forward(ip net.IP) string {
+	labels := strings.Split(reverseIP(ip), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// expand expands the macros in a domain-spec (RFC 7208 section 7).
+func (s *spfCheck) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", errSPFPerm
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+		j := strings.IndexByte(spec[i:], '}')
+		if j < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+j]
+		i += j
+		var (
+			letter = macro[0]
+			upper  = letter >= 'A' && letter <= 'Z'
+		)
+		if upper {
+			letter += 'a' - 'A'
+		}
+		v, err := s.macroValue(letter, domain)
+		if err != nil {
+			return "", err
+		}
+		v, err = transformMacro(v, macro[1:])
+		if err != nil {
+			return "", err
+		}
+		if upper {
+			v = url.QueryEscape(v)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// transformMacro applies the transformers and delimiters following a macro
+// letter, such as "2r-" to reverse the parts split at hyphens and keep the
+// rightmost two.
+func transformMacro(v, t string) (string, error) {
+	var (
+		digits  int
+		reverse bool
+		delims  = "."
+	)
+	n := 0
+	for n < len(t) && t[n] >= '0' && t[n] <= '9' {
+		n++
+	}
+	if n != 0 {
+		d, err := strconv.Atoi(t[:n])
+		if err != nil || d == 0 {
+			return "", errSPFPerm
+		}
+		digits = d
+	}
+	t = t[n:]
+	if len(t) != 0 && (t[0] == 'r' || t[0] == 'R') {
+		reverse = true
+		t = t[1:]
+	}
+	if len(t) != 0 {
+		if strings.Trim(t, ".-+,/_=") != "" {
+			return "", errSPFPerm
+		}
+		delims = t
+	}
+	parts := strings.FieldsFunc(v, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits != 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// checkSPF performs the SPF check for the sender if it is enabled. Clients
+// that have authenticated are not checked since they are not expected to
+// send from addresses covered by the sender's SPF record.
+func (c *Client) checkSPF(from string) SPFResult {
+	a, ok := c.session.RemoteAddr.(*net.TCPAddr)
+	if !c.config.CheckSPF || !ok || len(c.session.AuthUser) != 0 {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, spfTimeout)
+	defer cancel()
+	return CheckSPF(ctx, c.resolver(), a.IP, from, c.session.Helo)
+}
+
+// SPF returns the result of the SPF check performed when MAIL was accepted,
+// or an empty string if it was not performed.
+func (c *Client) SPF() SPFResult {
+	return c.spf
+}
+
+// spfDomain returns the domain that was checked, for use in replies.
+func spfDomain(from, helo string) string {
+	if i := strings.LastIndexByte(from, '@'); i != -1 {
+		return from[i+1:]
+	}
+	return helo
+}
@@ -0,0 +1,72 @@
+package smtpsrv
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestCheckSPF(t *testing.T) {
+	resolver := testResolver{
+		"txt:example.com":              {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.com mx -all"},
+		"txt:_spf.example.com":         {"v=spf1 a:relay.example.com ~all"},
+		"relay.example.com":            {"198.51.100.1", "2001:db8::1"},
+		"mx:example.com":               {"mail.example.com."},
+		"mail.example.com":             {"203.0.113.5"},
+		"txt:soft.example.com":         {"v=spf1 ~all"},
+		"txt:redir.example.com":        {"v=spf1 redirect=example.com"},
+		"txt:two.example.com":          {"v=spf1 -all", "v=spf1 +all"},
+		"txt:bad.example.com":          {"v=spf1 foo:bar -all"},
+		"txt:macro.example.com":        {"v=spf1 exists:%{ir}.%{l1r+}.e.example.com -all"},
+		"1.2.0.192.user.e.example.com": {"127.0.0.2"},
+		"txt:loop.example.com":         {"v=spf1 include:loop.example.com -all"},
+	}
+	for _, v := range []struct {
+		ip     string
+		sender string
+		result SPFResult
+	}{
+		{"192.0.2.1", "user@example.com", SPFPass},
+		{"198.51.100.1", "user@example.com", SPFPass},
+		{"2001:db8::1", "user@example.com", SPFPass},
+		{"203.0.113.5", "user@example.com", SPFPass},
+		{"203.0.113.6", "user@example.com", SPFFail},
+		{"203.0.113.6", "user@soft.example.com", SPFSoftFail},
+		{"192.0.2.1", "user@redir.example.com", SPFPass},
+		{"203.0.113.6", "user@redir.example.com", SPFFail},
+		{"192.0.2.1", "user@none.example.com", SPFNone},
+		{"192.0.2.1", "user@two.example.com", SPFPermError},
+		{"192.0.2.1", "user@bad.example.com", SPFPermError},
+		{"192.0.2.1", "user@macro.example.com", SPFPass},
+		{"192.0.2.1", "other@macro.example.com", SPFFail},
+		{"192.0.2.1", "user@loop.example.com", SPFPermError},
+		{"192.0.2.1", "", SPFPass},
+	} {
+		r := CheckSPF(context.Background(), resolver, net.ParseIP(v.ip), v.sender, "example.com")
+		if r != v.result {
+			t.Fatalf("%s %s: %s != %s", v.ip, v.sender, r, v.result)
+		}
+	}
+}
+
+func TestTransformMacro(t *testing.T) {
+	for _, v := range []struct {
+		value     string
+		transform string
+		result    string
+	}{
+		{"a.b.c", "", "a.b.c"},
+		{"a.b.c", "r", "c.b.a"},
+		{"a.b.c", "2", "b.c"},
+		{"a.b.c", "1r", "a"},
+		{"a-b.c", "-", "a.b.c"},
+	} {
+		r, err := transformMacro(v.value, v.transform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != v.result {
+			t.Fatalf("%q != %q", r, v.result)
+		}
+	}
+}
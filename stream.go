@@ -0,0 +1,114 @@
+package smtpsrv
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	errStreamTooLarge    = errors.New("message size exceeds fixed maximum message size")
+	errStreamLineTooLong = errors.New("message contains a line that is too long")
+	errStreamEightBit    = errors.New("message contains 8-bit headers without SMTPUTF8")
+	errStreamClosed      = errors.New("handler has finished reading the message")
+
+	// streamErrors are returned by the reader when a message is rejected,
+	// keyed by the name of the reply sent to the client
+	streamErrors = map[string]error{
+		"data.too-large":     errStreamTooLarge,
+		"data.line-too-long": errStreamLineTooLong,
+		"data.8bit-headers":  errStreamEightBit,
+	}
+)
+
+// StreamHandler may be implemented by a Handler to receive the content of
+// messages sent with DATA as it arrives rather than once it has been received
+// in its entirety, avoiding the need to hold large messages in memory. The
+// message passed to ServeSMTPStream has an empty Body, no Raw content, and a
+// zero Size and Checksum, which are only known once the content has been
+// received and are filled in for the journal afterwards.
+// The reader returns the content with dot-stuffing removed; if the client
+// disconnects or the message is rejected (for being too large, for example),
+// it returns an error and the handler's return value is ignored. The same
+// happens when the message timeout expires, in which case the client is sent
+// the "data.timeout" reply whether or not the handler returns. Messages
+// sent with BDAT are passed to ServeSMTPStream once they have been received,
+// with Body and Raw set as usual.
+type StreamHandler interface {
+	ServeSMTPStream(ctx context.Context, m *Message, r io.Reader) error
+}
+
+// streamData passes the content following DATA to the handler as it is
+// read. The handler runs in a separate goroutine while the content is read,
+// and once it returns, any remaining content is discarded. When the context
+// expires, the stream is closed so that a handler that has stopped reading
+// cannot stall the session, and a handler that has not returned is
+// abandoned. False is returned if the content could not be read, in which
+// case the session should end.
+func (c *Client) streamData(h StreamHandler) bool {
+	var (
+		m       = c.buildMessage(nil, "", nil)
+		started = c.mailTime
+		n       = len(c.rcpts)
+		pr, pw  = io.Pipe()
+		result  = make(chan error, 1)
+		r       io.Reader
+	)
+	c.reset()
+	// The trace headers are added to the stream instead
+	r = pr
+	if len(m.Body) != 0 {
+		r = io.MultiReader(strings.NewReader(m.Body), pr)
+		m.Body = ""
+	}
+	ctx, cancel := c.messageContext()
+	defer cancel()
+	go func() {
+		err := h.ServeSMTPStream(ctx, m, r)
+		pr.CloseWithError(errStreamClosed)
+		result <- err
+	}()
+	go func() {
+		<-ctx.Done()
+		pw.CloseWithError(ctx.Err())
+	}()
+	wait := func() error {
+		select {
+		case err := <-result:
+			if err == context.DeadlineExceeded {
+				err = errMessageTimeout
+			}
+			return err
+		case <-ctx.Done():
+			return errMessageTimeout
+		}
+	}
+	var w io.Writer = pw
+	if len(c.config.MetadataPrefix) != 0 {
+		w = &headerFilter{w: pw, prefix: c.config.MetadataPrefix}
+	}
+	hash := sha256.New()
+	size, reject, err := c.readData(w, hash)
+	switch {
+	case err != nil:
+		pw.CloseWithError(err)
+		wait()
+		return false
+	case len(reject) != 0:
+		pw.CloseWithError(streamErrors[reject])
+		wait()
+		r := c.lookupReply(reject)
+		m.Size = size
+		c.replyData(n, r)
+		c.finished(m, started, "rejected", reject, r)
+	default:
+		pw.Close()
+		err := wait()
+		m.Size = size
+		copy(m.Checksum[:], hash.Sum(nil))
+		c.finishMessage(m, started, err)
+	}
+	return true
+}
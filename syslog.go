@@ -0,0 +1,97 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errNoSyslog = errors.New("unable to connect to local syslog daemon")
+
+// syslogPriority is the PRI of each message, which uses the mail facility (2)
+// and informational severity (6).
+const syslogPriority = 2*8 + 6
+
+// syslogSockets are the paths tried when connecting to the local daemon.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogWriter sends each call to Write as a syslog message (RFC 5424) with
+// the mail facility. It can be used as Config.Journal so that transactions
+// are recorded in a traditional mail logging pipeline.
+type SyslogWriter struct {
+	mutex    sync.Mutex
+	conn     net.Conn
+	stream   bool
+	hostname string
+}
+
+// NewSyslogWriter connects to a syslog daemon. If network is empty, the
+// local daemon is used; otherwise, network and addr are passed to net.Dial
+// ("udp" or "tcp"). If tlsConfig is not nil, the connection is made with TLS
+// (RFC 5425). Messages sent over TCP are framed with octet counting (RFC
+// 6587).
+func NewSyslogWriter(network, addr string, tlsConfig *tls.Config) (*SyslogWriter, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case len(network) == 0:
+		for _, p := range syslogSockets {
+			if conn, err = net.Dial("unixgram", p); err == nil {
+				break
+			}
+		}
+		if conn == nil {
+			return nil, errNoSyslog
+		}
+	case tlsConfig != nil:
+		conn, err = tls.Dial(network, addr, tlsConfig)
+	default:
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &SyslogWriter{
+		conn:     conn,
+		stream:   network == "tcp" || network == "tcp4" || network == "tcp6",
+		hostname: hostname,
+	}, nil
+}
+
+// Write sends b (without any trailing newline) as a single message.
+func (w *SyslogWriter) Write(b []byte) (int, error) {
+	msg := fmt.Sprintf(
+		"<%d>1 %s %s %s %d - - %s",
+		syslogPriority,
+		time.Now().UTC().Format(time.RFC3339Nano),
+		w.hostname,
+		libraryName,
+		os.Getpid(),
+		bytes.TrimRight(b, "\n"),
+	)
+	if w.stream {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := w.conn.Write([]byte(msg)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close disconnects from the syslog daemon.
+func (w *SyslogWriter) Close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,92 @@
+package smtpsrv
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+var errNoSystemdSockets = errors.New("no sockets were passed by systemd")
+
+// systemdListeners returns the sockets passed to the process by systemd
+// (see sd_listen_fds(3)) along with their names from FileDescriptorName=.
+// The environment variables are removed so that child processes do not
+// inherit them.
+func systemdListeners() ([]net.Listener, []string, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, errNoSystemdSockets
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, errNoSystemdSockets
+	}
+	var (
+		names     = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		listeners []net.Listener
+	)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFDsStart+i), "LISTEN_FD_"+strconv.Itoa(i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(names) != n {
+		names = make([]string, n)
+	}
+	return listeners, names, nil
+}
+
+// NewSystemdServer creates a new server that accepts connections on the
+// sockets passed to the process by systemd socket activation, allowing it to
+// be started on demand and to use privileged ports without running as root.
+// Addr is ignored. Each socket named (with FileDescriptorName=) after one of
+// Listeners uses its settings, while the others use the server's
+// configuration. An error is returned if no sockets were passed.
+func NewSystemdServer(config *Config) (*Server, error) {
+	ls, names, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		s         = New(config)
+		listeners = make([]*Listener, len(ls))
+	)
+	for i, l := range ls {
+		listeners[i] = &Listener{Name: names[i]}
+		for _, li := range config.Listeners {
+			if len(names[i]) != 0 && li.Name == names[i] {
+				listeners[i] = li
+			}
+		}
+		w, err := s.wrap(l, listeners[i])
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls[i] = w
+	}
+	for i, l := range ls {
+		s.track(l, listeners[i])
+		go s.serve(l, listeners[i])
+	}
+	return s, nil
+}
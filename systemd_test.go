@@ -0,0 +1,20 @@
+package smtpsrv
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSystemdNoSockets(t *testing.T) {
+	for _, pid := range []string{"", "1", strconv.Itoa(os.Getpid())} {
+		os.Setenv("LISTEN_PID", pid)
+		os.Setenv("LISTEN_FDS", "0")
+		if _, err := NewSystemdServer(&Config{}); err != errNoSystemdSockets {
+			t.Fatalf("%v != %v", err, errNoSystemdSockets)
+		}
+		if v := os.Getenv("LISTEN_PID"); len(v) != 0 {
+			t.Fatalf("LISTEN_PID not removed: %q", v)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package testutil provides helpers for exercising an SMTP server under load
+// and verifying that it does not leak resources in the process.
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/textproto"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// SoakConfig controls the sessions opened by Soak.
+type SoakConfig struct {
+	// Address of the server
+	Addr string
+	// Total number of sessions to open
+	Sessions int
+	// Number of sessions open at any one time
+	Concurrency int
+	// Seed for choosing the commands sent in each session
+	Seed int64
+}
+
+// step is a line sent to the server and the reply code expected in return. A
+// code of zero indicates that no reply is expected.
+type step struct {
+	line string
+	code int
+}
+
+// scripts lists the command sequences that sessions choose from. A nil step
+// indicates that the connection should be dropped without QUIT.
+var scripts = [][]*step{
+	// Complete transaction
+	{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<a@localhost>", 250},
+		{"RCPT TO:<b@localhost>", 250},
+		{"DATA", 354},
+		{"test\r\n.", 250},
+		{"QUIT", 221},
+	},
+	// Transaction abandoned with RSET
+	{
+		{"HELO localhost", 250},
+		{"MAIL FROM:<a@localhost>", 250},
+		{"RSET", 250},
+		{"NOOP", 250},
+		{"QUIT", 221},
+	},
+	// Unknown and out-of-sequence commands
+	{
+		{"EHLO localhost", 250},
+		{"XUNKNOWN", 502},
+		{"RCPT TO:<b@localhost>", 503},
+		{"QUIT", 221},
+	},
+	// Disconnect immediately after the greeting
+	{
+		nil,
+	},
+	// Disconnect in the middle of DATA
+	{
+		{"EHLO localhost", 250},
+		{"MAIL FROM:<a@localhost>", 250},
+		{"RCPT TO:<b@localhost>", 250},
+		{"DATA", 354},
+		{"partial", 0},
+		nil,
+	},
+}
+
+// runSession connects to the server and runs through the script.
+func runSession(addr string, script []*step) error {
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+	for _, s := range script {
+		if s == nil {
+			return nil
+		}
+		if err := c.PrintfLine("%s", s.line); err != nil {
+			return err
+		}
+		if s.code == 0 {
+			continue
+		}
+		if _, _, err := c.ReadResponse(s.code); err != nil {
+			return fmt.Errorf("%s: %s", s.line, err)
+		}
+	}
+	return nil
+}
+
+// Soak opens the configured number of sessions to the server, each running a
+// randomly chosen mix of commands, and returns the first error encountered.
+// The server is expected to accept every message it is sent.
+func Soak(config *SoakConfig) error {
+	var (
+		r        = rand.New(rand.NewSource(config.Seed))
+		sem      = make(chan bool, config.Concurrency)
+		errMutex sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < config.Sessions; i++ {
+		script := scripts[r.Intn(len(scripts))]
+		sem <- true
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := runSession(config.Addr, script); err != nil {
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Snapshot records the number of goroutines and open file descriptors in the
+// current process.
+type Snapshot struct {
+	Goroutines int
+	// Number of open file descriptors or -1 if it cannot be determined
+	FDs int
+}
+
+// openFDs counts the open file descriptors using /proc, returning -1 on
+// platforms where it is not available.
+func openFDs() int {
+	f, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(f)
+}
+
+// TakeSnapshot records the current resource usage.
+func TakeSnapshot() Snapshot {
+	return Snapshot{
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        openFDs(),
+	}
+}
+
+// CheckLeaks compares current resource usage to the snapshot, allowing for
+// the specified slack. Since resources may take a moment to be released,
+// usage is sampled repeatedly until it falls within the limits or the
+// timeout expires.
+func (s Snapshot) CheckLeaks(slack int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		c := TakeSnapshot()
+		goroutinesOK := c.Goroutines <= s.Goroutines+slack
+		fdsOK := s.FDs == -1 || c.FDs <= s.FDs+slack
+		if goroutinesOK && fdsOK {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"leak detected: %d -> %d goroutines, %d -> %d fds",
+				s.Goroutines, c.Goroutines, s.FDs, c.FDs,
+			)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
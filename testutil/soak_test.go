@@ -0,0 +1,36 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hectane/go-smtpsrv"
+)
+
+func TestSoak(t *testing.T) {
+	before := TakeSnapshot()
+	s, err := smtpsrv.NewServer(&smtpsrv.Config{
+		Addr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range s.NewMessage {
+		}
+	}()
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	if err := Soak(&SoakConfig{
+		Addr:        s.Addr().String(),
+		Sessions:    2000,
+		Concurrency: 50,
+		Seed:        seed,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(false)
+	if err := before.CheckLeaks(0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+package smtpsrv
+
+import (
+	"time"
+)
+
+// Timeouts recommended by RFC 5321 section 4.5.3.2, used when neither the
+// specific timeout nor ReadTimeout is set.
+const (
+	defaultGreetingTimeout  = 5 * time.Minute
+	defaultCommandTimeout   = 5 * time.Minute
+	defaultDataStartTimeout = 2 * time.Minute
+	defaultDataBlockTimeout = 3 * time.Minute
+)
+
+// readTimeout determines the timeout for a read from the client. A negative
+// timeout disables it, and if it is not set, ReadTimeout (if set) or the
+// default is used.
+func (c *Client) readTimeout(timeout, def time.Duration) time.Duration {
+	switch {
+	case timeout < 0:
+		return 0
+	case timeout > 0:
+		return timeout
+	case c.config.ReadTimeout != 0:
+		return c.config.ReadTimeout
+	}
+	return def
+}
+
+// greetingTimeout is the timeout for the PROXY header and the first command.
+func (c *Client) greetingTimeout() time.Duration {
+	return c.readTimeout(c.config.GreetingTimeout, defaultGreetingTimeout)
+}
+
+// commandTimeout is the timeout for each subsequent command and for AUTH
+// responses.
+func (c *Client) commandTimeout() time.Duration {
+	return c.readTimeout(c.config.CommandTimeout, defaultCommandTimeout)
+}
+
+// dataStartTimeout is the timeout for the first line of content after DATA.
+func (c *Client) dataStartTimeout() time.Duration {
+	return c.readTimeout(c.config.DataStartTimeout, defaultDataStartTimeout)
+}
+
+// dataBlockTimeout is the timeout for each subsequent line of content and for
+// the content of each BDAT chunk.
+func (c *Client) dataBlockTimeout() time.Duration {
+	return c.readTimeout(c.config.DataBlockTimeout, defaultDataBlockTimeout)
+}
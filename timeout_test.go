@@ -0,0 +1,30 @@
+package smtpsrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	c := &Client{config: &Config{
+		CommandTimeout:   time.Second,
+		DataBlockTimeout: -1,
+	}}
+	for _, v := range []struct {
+		timeout  time.Duration
+		expected time.Duration
+	}{
+		{c.greetingTimeout(), defaultGreetingTimeout},
+		{c.commandTimeout(), time.Second},
+		{c.dataStartTimeout(), defaultDataStartTimeout},
+		{c.dataBlockTimeout(), 0},
+	} {
+		if v.timeout != v.expected {
+			t.Fatalf("%s != %s", v.timeout, v.expected)
+		}
+	}
+	c.config.ReadTimeout = time.Minute
+	if d := c.greetingTimeout(); d != time.Minute {
+		t.Fatalf("%s != %s", d, time.Minute)
+	}
+}
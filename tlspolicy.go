@@ -0,0 +1,45 @@
+package smtpsrv
+
+import (
+	"strings"
+)
+
+// TLSPolicy determines whether mail from a sender domain must arrive over
+// TLS.
+type TLSPolicy int
+
+const (
+	// TLSOptional accepts mail with or without TLS.
+	TLSOptional TLSPolicy = iota
+	// TLSRequired rejects mail unless the connection uses TLS.
+	TLSRequired
+	// TLSVerified rejects mail unless the connection uses TLS and the client
+	// presented a certificate that was verified, which requires ClientAuth to
+	// be set in TLSConfig.
+	TLSVerified
+)
+
+// senderDomain returns the domain of an envelope address in lowercase.
+func senderDomain(address string) string {
+	i := strings.LastIndex(address, "@")
+	if i == -1 {
+		return ""
+	}
+	return strings.ToLower(address[i+1:])
+}
+
+// checkTLSPolicy determines whether mail from the address may be accepted
+// under the policy for its domain.
+func (c *Client) checkTLSPolicy(address string) bool {
+	var (
+		policy = c.config.SenderTLSPolicy[senderDomain(address)]
+		s      = c.session.TLS
+	)
+	switch policy {
+	case TLSRequired:
+		return s != nil
+	case TLSVerified:
+		return s != nil && len(s.VerifiedChains) != 0
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package smtpsrv
+
+import (
+	"bytes"
+)
+
+// hasVerifyAddress determines whether VRFY is available.
+func hasVerifyAddress(config *Config) bool {
+	return config.VerifyAddress != nil
+}
+
+// hasExpandList determines whether EXPN is available.
+func hasExpandList(config *Config) bool {
+	return config.ExpandList != nil
+}
+
+// processVRFY asks the application whether the address (or name) identifies
+// a user. The command is disabled unless Config.VerifyAddress is set.
+func (c *Client) processVRFY(b []byte) {
+	s := string(bytes.TrimSpace(b))
+	if len(s) == 0 {
+		c.reply("vrfy.syntax")
+		return
+	}
+	c.sendReply(c.config.VerifyAddress(c, s))
+}
+
+// processEXPN asks the application for the members of a mailing list. The
+// members are expected to be separated by newlines in the reply so that each
+// is sent on its own line.
+func (c *Client) processEXPN(b []byte) {
+	s := string(bytes.TrimSpace(b))
+	if len(s) == 0 {
+		c.reply("expn.syntax")
+		return
+	}
+	c.sendReply(c.config.ExpandList(c, s))
+}
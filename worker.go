@@ -0,0 +1,47 @@
+package smtpsrv
+
+// startWorkers starts the goroutines that serve clients if Workers is set.
+func (s *Server) startWorkers() {
+	if s.config.Workers <= 0 {
+		return
+	}
+	s.queue = make(chan *Client, s.config.Workers)
+	for i := 0; i < s.config.Workers; i++ {
+		go func() {
+			for c := range s.queue {
+				s.runClient(c)
+			}
+		}()
+	}
+}
+
+// stopWorkers allows the workers to exit once they have served the clients
+// remaining in the queue. No clients may be dispatched afterwards.
+func (s *Server) stopWorkers() {
+	if s.queue != nil {
+		s.workersStopped.Do(func() {
+			close(s.queue)
+		})
+	}
+}
+
+// dispatch queues the client for a worker, waiting for room in the queue if
+// necessary, or serves it in its own goroutine if there are no workers. A
+// client accepted as the server stops is also served in its own goroutine so
+// that shutdown does not wait for room in the queue.
+func (s *Server) dispatch(c *Client) {
+	if s.queue != nil {
+		select {
+		case s.queue <- c:
+			return
+		case <-s.stopped:
+		}
+	}
+	go s.runClient(c)
+}
+
+// runClient runs the client until it disconnects.
+func (s *Server) runClient(c *Client) {
+	c.run(s.ctx)
+	s.registry.remove(c)
+}